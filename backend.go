@@ -24,13 +24,15 @@ func NewBackend(cnf *config.Config) backends.Backend {
 
 // InitGroup - saves UUIDs of all tasks in a group
 func (pb *Backend) InitGroup(groupUUID string, taskUUIDs []string) error {
+	tasks := make([]*Task, 0, len(taskUUIDs))
 	for _, taskUUID := range taskUUIDs {
 		t := NewTaskWithID(taskUUID)
 		t.GroupUUID = NGUUID(groupUUID)
-		db := DB.FirstOrCreate(t)
-		if db.Error != nil {
-			return fmt.Errorf("InitGroup: %s", db.Error)
-		}
+		tasks = append(tasks, t)
+	}
+
+	if err := insertTasks(DB, tasks, "ON CONFLICT (uuid) DO NOTHING"); err != nil {
+		return fmt.Errorf("InitGroup: %s", err)
 	}
 	return nil
 }
@@ -44,7 +46,11 @@ func (pb *Backend) GroupCompleted(groupUUID string, groupTaskCount int) (bool, e
 
 	countSuccessTasks := 0
 	for _, task := range tasks {
-		if !task.TaskState().IsCompleted() {
+		state, err := taskState(DB, task)
+		if err != nil {
+			return false, fmt.Errorf("GroupCompleted: %s", err)
+		}
+		if !state.IsCompleted() {
 			return false, nil
 		}
 		countSuccessTasks++
@@ -61,7 +67,11 @@ func (pb *Backend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*bac
 
 	taskStates := make([]*backends.TaskState, 0, groupTaskCount)
 	for _, task := range tasks {
-		taskStates = append(taskStates, task.TaskState())
+		state, err := taskState(DB, task)
+		if err != nil {
+			return nil, fmt.Errorf("GroupTaskStates: %s", err)
+		}
+		taskStates = append(taskStates, state)
 	}
 
 	return taskStates, nil
@@ -74,7 +84,7 @@ func (pb *Backend) SetStatePending(signature *signatures.TaskSignature) error {
 		return fmt.Errorf("SetStatePending: %s", err)
 	}
 
-	return DB.Model(task).Update("state", backends.PendingState).Error
+	return DB.Model(task).Where("state <> ?", RevokedState).Update("state", backends.PendingState).Error
 }
 
 // SetStateReceived - sets task state to RECEIVED
@@ -84,7 +94,7 @@ func (pb *Backend) SetStateReceived(signature *signatures.TaskSignature) error {
 		return fmt.Errorf("SetStateReceived: %s", err)
 	}
 
-	return DB.Model(task).Update("state", backends.ReceivedState).Error
+	return DB.Model(task).Where("state <> ?", RevokedState).Update("state", backends.ReceivedState).Error
 }
 
 // SetStateStarted - sets task state to STARTED
@@ -94,7 +104,7 @@ func (pb *Backend) SetStateStarted(signature *signatures.TaskSignature) error {
 		return fmt.Errorf("SetStateStarted: %s", err)
 	}
 
-	return DB.Model(task).Update("state", backends.StartedState).Error
+	return DB.Model(task).Where("state <> ?", RevokedState).Update("state", backends.StartedState).Error
 }
 
 // SetStateSuccess - sets task state to SUCCESS
@@ -104,7 +114,7 @@ func (pb *Backend) SetStateSuccess(signature *signatures.TaskSignature, result *
 		return fmt.Errorf("SetStateSuccess: %s", err)
 	}
 
-	return DB.Model(task).Updates(map[string]interface{}{
+	return DB.Model(task).Where("state <> ?", RevokedState).Updates(map[string]interface{}{
 		"result": task.MarshalResult(result),
 		"state":  backends.SuccessState,
 	}).Error
@@ -117,7 +127,7 @@ func (pb *Backend) SetStateFailure(signature *signatures.TaskSignature, err stri
 		return fmt.Errorf("SetStateFailure: %s", err)
 	}
 
-	return DB.Model(task).Updates(map[string]interface{}{
+	return DB.Model(task).Where("state <> ?", RevokedState).Updates(map[string]interface{}{
 		"state": backends.FailureState,
 		"error": err,
 	}).Error
@@ -131,7 +141,12 @@ func (pb *Backend) GetState(taskUUID string) (*backends.TaskState, error) {
 	if err := DB.First(task).Error; err != nil {
 		return nil, fmt.Errorf("GetState: %s", err)
 	}
-	return task.TaskState(), nil
+
+	state, err := taskState(DB, task)
+	if err != nil {
+		return nil, fmt.Errorf("GetState: %s", err)
+	}
+	return state, nil
 }
 
 // PurgeState - deletes stored task state
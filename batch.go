@@ -0,0 +1,174 @@
+package machinerypg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/jinzhu/gorm"
+)
+
+// insertBatchSize is the number of rows per INSERT statement, bounded by the 65535 parameters of a Postgres query
+const insertBatchSize = 1000
+
+// PublishBatch places the given messages at once, in a single transaction with multi-row INSERT statements.
+// The options apply to all the tasks, tasks with a deduplication, uniqueness or coalesce key are published one by one.
+func (pb *Broker) PublishBatch(sigs []*signatures.TaskSignature, opts ...PublishOption) error {
+	o := newPublishOptions(opts)
+
+	tasks := make([]*Task, 0, len(sigs))
+	// Indexes of the tasks published one by one, in input order
+	// so the publish order (e.g. WithOrderingKey, WithDebounce) is kept
+	deduped := []int{}
+	byIndex := map[int]*Task{}
+	queues := map[string]bool{}
+	for i, sig := range sigs {
+		t, err := pb.newTask(sig, o)
+		if err != nil {
+			return fmt.Errorf("PublishBatch: %s", err)
+		}
+
+		if t.DedupKey != nil || t.UniqueKey != nil || t.CoalesceKey != nil {
+			deduped = append(deduped, i)
+			byIndex[i] = t
+			continue
+		}
+		tasks = append(tasks, t)
+		queues[t.Queue] = true
+	}
+
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("PublishBatch: %s", tx.Error)
+	}
+
+	// Like in Publish, ordering keys are locked until commit, in a stable order against deadlocks
+	keys := []string{}
+	for _, t := range tasks {
+		if t.OrderingKey != nil {
+			keys = append(keys, *t.OrderingKey)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		if err := lockKey(tx, orderingLock, key); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("PublishBatch: %s", err)
+		}
+	}
+
+	// Existing tasks (e.g. created by Backend.InitGroup) are updated like in Publish
+	err := insertTasks(tx, tasks, `ON CONFLICT (uuid) DO UPDATE SET
+		consumed = EXCLUDED.consumed,
+		locked_until = NULL,
+		locked_by = '',
+		state = EXCLUDED.state,
+		name = EXCLUDED.name,
+		group_uuid = EXCLUDED.group_uuid,
+		queue = EXCLUDED.queue,
+		run_at = EXCLUDED.run_at,
+		priority = EXCLUDED.priority,
+		ordering_key = EXCLUDED.ordering_key,
+		raw_task = EXCLUDED.raw_task,
+		updated_at = EXCLUDED.updated_at`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("PublishBatch: %s", err)
+	}
+
+	// Wake up the consumers, the notifications are sent on commit
+	for queue := range queues {
+		if err := notify(tx, queue, ""); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("PublishBatch: %s", err)
+		}
+	}
+
+	uuids := make([]string, len(deduped))
+	for j, i := range deduped {
+		uuid, err := publish(tx, byIndex[i], o)
+		if err == ErrTaskNotUnique {
+			tx.Rollback()
+			return err
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("PublishBatch: %s", err)
+		}
+		uuids[j] = uuid
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("PublishBatch: %s", err)
+	}
+
+	for j, i := range deduped {
+		if uuids[j] != byIndex[i].UUID {
+			sigs[i].UUID = "task_" + uuids[j]
+		}
+	}
+	return nil
+}
+
+// insertTasks writes the given tasks with multi-row INSERT statements ended by the given conflict clause
+func insertTasks(tx *gorm.DB, tasks []*Task, onConflict string) error {
+	now := gorm.NowFunc()
+	for _, t := range tasks {
+		t.CreatedAt = &now
+		t.UpdatedAt = &now
+	}
+
+	scope := tx.NewScope(&Task{})
+	for start := 0; start < len(tasks); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+
+		var columns []string
+		var values []interface{}
+		query := &bytes.Buffer{}
+		for i, t := range tasks[start:end] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(")
+
+			n := 0
+			for _, field := range tx.NewScope(t).Fields() {
+				if !field.IsNormal || field.IsIgnored {
+					continue
+				}
+				if i == 0 {
+					columns = append(columns, scope.Quote(field.DBName))
+				}
+				if n > 0 {
+					query.WriteString(", ")
+				}
+				if field.IsBlank && field.HasDefaultValue {
+					// Like Create, the database computes blank values (e.g. the sequence of the tasks)
+					query.WriteString("DEFAULT")
+					n++
+					continue
+				}
+				values = append(values, field.Field.Interface())
+				query.WriteString("$" + strconv.Itoa(len(values)))
+				n++
+			}
+			query.WriteString(")")
+		}
+
+		_, err := tx.CommonDB().Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES %s %s",
+			scope.QuotedTableName(), strings.Join(columns, ", "), query.String(), onConflict), values...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
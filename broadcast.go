@@ -0,0 +1,237 @@
+package machinerypg
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/jinzhu/gorm"
+)
+
+// ErrBroadcastCallbacks is returned when publishing a broadcast task with callbacks.
+var ErrBroadcastCallbacks = errors.New("callbacks are not supported by broadcast tasks")
+
+// BroadcastResult is the state of a broadcast task on a worker.
+type BroadcastResult struct {
+	WorkerID string
+	State    *backends.TaskState
+}
+
+// PublishBroadcast places the given task once for each live worker consuming its queue and name.
+// The signature's task is not delivered itself, its state aggregates the states of the per worker tasks:
+// it succeeds once all of them succeeded, with the number of workers as result, see BroadcastResults for their results.
+// The aggregated state is stored by the reaper (see StartReaperRoutine) once all the per worker tasks are completed.
+// The signature can belong to a group but callbacks (OnSuccess, OnError and ChordCallback) are not supported
+// since the signature's task is never processed, ErrBroadcastCallbacks is returned.
+func (pb *Broker) PublishBroadcast(task *signatures.TaskSignature, opts ...PublishOption) error {
+	if len(task.OnSuccess) > 0 || len(task.OnError) > 0 || task.ChordCallback != nil {
+		return ErrBroadcastCallbacks
+	}
+
+	o := newPublishOptions(opts)
+	parent, err := pb.newTask(task, o)
+	if err != nil {
+		return fmt.Errorf("PublishBroadcast: %s", err)
+	}
+	parent.Broadcast = true
+	parent.Consumed = true
+
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("PublishBroadcast: %s", tx.Error)
+	}
+
+	workers := []*Worker{}
+	err = tx.Where("heartbeat_at > ?", heartbeatDeadline()).
+		Where("? = ANY(queues)", parent.Queue).
+		Where("? = ANY(task_names)", parent.Name).
+		Find(&workers).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("PublishBroadcast: %s", err)
+	}
+
+	uuid, err := publish(tx, parent, o)
+	if err == ErrTaskNotUnique {
+		tx.Rollback()
+		return err
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("PublishBroadcast: %s", err)
+	}
+
+	if uuid == parent.UUID {
+		children := make([]*Task, 0, len(workers))
+		for _, worker := range workers {
+			sig := *task
+			sig.UUID = "task_" + NewUUID()
+			sig.GroupUUID = ""
+			sig.GroupTaskCount = 0
+
+			child, err := pb.newTask(&sig, newPublishOptions(nil))
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("PublishBroadcast: %s", err)
+			}
+			child.Priority = parent.Priority
+			child.ParentUUID = &parent.UUID
+			child.TargetWorker = worker.ID
+			children = append(children, child)
+		}
+
+		// The consumers are notified by publish on commit
+		if err := insertTasks(tx, children, ""); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("PublishBroadcast: %s", err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("PublishBroadcast: %s", err)
+	}
+
+	if uuid != parent.UUID {
+		task.UUID = "task_" + uuid
+	}
+	return nil
+}
+
+// BroadcastResults returns the state of the given broadcast task on each worker
+func BroadcastResults(taskUUID string) ([]*BroadcastResult, error) {
+	children, err := broadcastChildren(DB, UUID(taskUUID))
+	if err != nil {
+		return nil, fmt.Errorf("BroadcastResults: %s", err)
+	}
+
+	results := make([]*BroadcastResult, 0, len(children))
+	for _, child := range children {
+		results = append(results, &BroadcastResult{
+			WorkerID: child.TargetWorker,
+			State:    child.TaskState(),
+		})
+	}
+	return results, nil
+}
+
+// taskState returns the state of the given task, aggregated from the per worker tasks of a broadcast task
+// until it is finalized (see finalizeBroadcasts)
+func taskState(db *gorm.DB, t *Task) (*backends.TaskState, error) {
+	if !t.Broadcast || t.State != backends.PendingState {
+		return t.TaskState(), nil
+	}
+
+	children, err := broadcastChildren(db, t.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &backends.TaskState{
+		TaskUUID: "task_" + t.UUID,
+		State:    backends.PendingState,
+	}
+	completed := 0
+	failed := []*Task{}
+	for _, child := range children {
+		s := child.TaskState()
+		switch {
+		case s.IsSuccess():
+			completed++
+		case s.IsFailure():
+			completed++
+			failed = append(failed, child)
+		case s.State != backends.PendingState:
+			state.State = backends.StartedState
+		}
+	}
+	if completed > 0 {
+		state.State = backends.StartedState
+	}
+	if completed < len(children) {
+		return state, nil
+	}
+
+	if len(failed) > 0 {
+		state.State = backends.FailureState
+		state.Error = fmt.Sprintf("failed on %d/%d workers: %s: %s", len(failed), len(children), failed[0].TargetWorker, failed[0].Error)
+		return state, nil
+	}
+
+	state.State = backends.SuccessState
+	state.Result = &backends.TaskResult{Type: "int64", Value: int64(len(children))}
+	return state, nil
+}
+
+// broadcastChildren returns the per worker tasks of the given broadcast task
+func broadcastChildren(db *gorm.DB, parentUUID string) ([]*Task, error) {
+	children := []*Task{}
+	err := db.Where("parent_uuid = ?", parentUUID).
+		Order("target_worker").
+		Find(&children).Error
+	return children, err
+}
+
+// finalizeBroadcasts stores the aggregated state of the broadcast tasks whose per worker tasks are all completed,
+// so they are cleaned up and counted like the other tasks
+func finalizeBroadcasts() (int, error) {
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	parents := []*Task{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("broadcast = ?", true).
+		Where("state = ?", backends.PendingState).
+		Where("NOT EXISTS (SELECT 1 FROM tasks child WHERE child.parent_uuid = tasks.uuid AND child.state NOT IN (?))",
+			[]string{backends.SuccessState, backends.FailureState, RevokedState}).
+		Find(&parents).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, parent := range parents {
+		state, err := taskState(tx, parent)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		updates := map[string]interface{}{
+			"state": state.State,
+			"error": state.Error,
+		}
+		if state.Result != nil {
+			updates["result"] = parent.MarshalResult(state.Result)
+		}
+		if err := tx.Model(parent).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return len(parents), nil
+}
+
+// failOrphanBroadcasts fails the pending per worker tasks of the dead workers.
+// Tasks still leased are left to their worker, which deregisters before waiting for them when draining.
+func failOrphanBroadcasts() (int64, error) {
+	db := DB.Model(&Task{}).
+		Where("consumed = ?", false).
+		Where("target_worker != ''").
+		Where("locked_until IS NULL OR locked_until < now()").
+		Where("NOT EXISTS (SELECT 1 FROM workers WHERE workers.id = tasks.target_worker AND workers.heartbeat_at > ?)", heartbeatDeadline()).
+		Updates(map[string]interface{}{
+			"consumed":     true,
+			"locked_until": nil,
+			"locked_by":    "",
+			"state":        backends.FailureState,
+			"error":        "target worker is dead",
+		})
+	return db.RowsAffected, db.Error
+}
@@ -2,30 +2,68 @@ package machinerypg
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
-	"github.com/RichardKnop/machinery/v1/backends"
 	"github.com/RichardKnop/machinery/v1/brokers"
 	"github.com/RichardKnop/machinery/v1/config"
 	"github.com/RichardKnop/machinery/v1/signatures"
 	"github.com/RichardKnop/machinery/v1/utils"
 )
 
+// FallbackPollInterval is the interval at which the consumer polls the database
+// when no notification has been received (e.g. lost notifications during a reconnection).
+var FallbackPollInterval = 30 * time.Second
+
+// LeaseDuration is the time a worker owns a claimed task.
+// Once expired, the task is delivered to another worker.
+var LeaseDuration = 5 * time.Minute
+
+// HeartbeatInterval is the interval at which a worker extends the leases of its in-flight tasks.
+// It must be lower than LeaseDuration.
+var HeartbeatInterval = 1 * time.Minute
+
+// DefaultDrainTimeout is the default time StopConsuming waits for the in-flight tasks.
+var DefaultDrainTimeout = 30 * time.Second
+
+// PriorityAging is the waiting time after which a pending task gains one priority level,
+// so low priority tasks are not starved by a continuous flow of high priority ones.
+// Aging is disabled when zero.
+var PriorityAging time.Duration
+
 // Broker contains all stuff fot using Postgres as a Machinery broker
 type Broker struct {
+	url                 string
+	workerID            string
+	consumerTag         string
+	defaultQueue        string
+	queues              []string
 	registeredTaskNames []string
+	reloadTasks         func() ([]string, error)
 	retry               bool
 	retryFunc           func()
 	stopChan            chan int
+	stopOnce            *sync.Once
+	drained             chan struct{}
+	drainedOnce         *sync.Once
 	stopReceivingChan   chan int
+	stopReceivingOnce   *sync.Once
 	errorsChan          chan error
 	maxParallelTasks    int
-	limiter             chan struct{}
+	running             int
+	wakeup              chan struct{}
+	inFlight            map[string]*Task
+	contexts            map[string]*taskContext
+	concurrency         map[Scope]map[string]int
+	unstarted           []string
+	drainTimeout        time.Duration
+	heartbeat           sync.Once
 	wg                  sync.WaitGroup
+	processing          sync.WaitGroup
 	mu                  sync.Mutex
 }
 
@@ -36,8 +74,18 @@ func NewBroker(cnf *config.Config) brokers.Broker {
 		panic(fmt.Errorf("NewBroker: %s", err))
 	}
 	return &Broker{
+		url:              cnf.Broker,
+		defaultQueue:     cnf.DefaultQueue,
+		queues:           []string{cnf.DefaultQueue},
 		maxParallelTasks: 6,
 		retry:            true,
+		inFlight:         map[string]*Task{},
+		contexts:         map[string]*taskContext{},
+		concurrency: map[Scope]map[string]int{
+			TaskScope:  {},
+			QueueScope: {},
+		},
+		drainTimeout: DefaultDrainTimeout,
 	}
 }
 
@@ -53,17 +101,52 @@ func (pb *Broker) SetMaxParallelTasks(n int) {
 	defer pb.mu.Unlock()
 
 	pb.maxParallelTasks = n
-	pb.limiter = make(chan struct{}, pb.maxParallelTasks)
+	// The receiving goroutine claims more tasks when increased,
+	// when decreased the running tasks are not interrupted
+	pb.wake()
+}
+
+// SetConcurrency caps the number of tasks of the given task name or queue processed at once by this broker.
+// A non-positive max removes the cap. See SetClusterConcurrency for a cap across all the workers.
+func (pb *Broker) SetConcurrency(scope Scope, name string, max int) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if max <= 0 {
+		delete(pb.concurrency[scope], name)
+		return
+	}
+	pb.concurrency[scope][name] = max
+}
+
+// SetDrainTimeout sets the time StopConsuming waits for the in-flight tasks
+func (pb *Broker) SetDrainTimeout(timeout time.Duration) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.drainTimeout = timeout
+}
+
+// SetQueues sets the queues consumed by this broker (default to config's DefaultQueue)
+func (pb *Broker) SetQueues(queues ...string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.queues = queues
 }
 
 // SetRegisteredTaskNames sets registered task names
 func (pb *Broker) SetRegisteredTaskNames(names []string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
 	pb.registeredTaskNames = names
 }
 
 // IsTaskRegistered returns true if the task is registered with this broker
 func (pb *Broker) IsTaskRegistered(name string) bool {
-	for _, registeredTaskName := range pb.registeredTaskNames {
+	_, names := pb.consumed()
+	for _, registeredTaskName := range names {
 		if registeredTaskName == name {
 			return true
 		}
@@ -78,10 +161,18 @@ func (pb *Broker) StartConsuming(consumerTag string, taskProcessor brokers.TaskP
 	}
 
 	pb.retryFunc = utils.RetryClosure()
+	pb.workerID = newWorkerID(consumerTag)
 	pb.stopChan = make(chan int)
+	pb.stopOnce = &sync.Once{}
+	pb.drained = make(chan struct{})
+	pb.drainedOnce = &sync.Once{}
 	pb.stopReceivingChan = make(chan int)
-	pb.errorsChan = make(chan error)
+	pb.stopReceivingOnce = &sync.Once{}
+	pb.errorsChan = make(chan error, 1)
 	deliveries := make(chan *Task)
+	pb.mu.Lock()
+	pb.wakeup = make(chan struct{}, 1)
+	pb.mu.Unlock()
 
 	if err := DB.DB().Ping(); err != nil {
 		// Machinery polls StartConsuming so retryFunc is called and blocks the polling.
@@ -89,116 +180,136 @@ func (pb *Broker) StartConsuming(consumerTag string, taskProcessor brokers.TaskP
 		return pb.retry, err // retry true
 	}
 
-	pb.wg.Add(1)
-	go func() {
-		defer pb.wg.Done()
-		ticker := time.NewTicker(1 * time.Second) // Use notfication instead polling?
-
-		fmt.Println("[*] Waiting for messages. To exit press CTRL+C")
-		for {
-			select {
-			// A way to stop this goroutine from redisBroker.StopConsuming
-			case <-pb.stopReceivingChan:
-				return
-			case <-ticker.C:
-				task := NewTask()
-
-				// Start transaction to ensure there is no race condition
-				tx := DB.Begin()
-
-				err := tx.Set("gorm:query_option", "FOR UPDATE").
-					Where("consumed = ?", false).
-					Where("raw_task != '{}'").
-					Where("name in (?)", pb.registeredTaskNames).
-					Order("created_at").
-					First(task).Error
-				if tx.Error != nil {
-					pb.errorsChan <- fmt.Errorf("StartConsuming: %s", err)
-				}
-
-				if task.UUID != "" {
-					err = tx.Model(task).Update("consumed", true).Error
-					if tx.Error != nil {
-						pb.errorsChan <- fmt.Errorf("StartConsuming: %s", err)
-					}
-				}
+	queues, _ := pb.consumed()
+	channels := make([]string, 0, len(queues))
+	for _, queue := range queues {
+		channels = append(channels, notifyChannel(queue))
+	}
+	listener, err := newListener(pb.url, channels...)
+	if err != nil {
+		pb.retryFunc()
+		return pb.retry, fmt.Errorf("StartConsuming: %s", err)
+	}
 
-				if err := DB.DB().Ping(); err != nil {
-					// Start retry if connection refused
-					// NOTE: tx.Commit() panics when connection refused error occurred
-					pb.errorsChan <- fmt.Errorf("StartConsuming: %s", err)
-					break
-				} else {
-					// End of the transaction
-					tx.Commit()
-				}
+	pb.mu.Lock()
+	pb.consumerTag = consumerTag
+	pb.mu.Unlock()
+	if err := pb.register(consumerTag); err != nil {
+		logg.Printf("Could not register worker: %s", err)
+	}
 
-				if tx.Error != nil {
-					pb.errorsChan <- fmt.Errorf("StartConsuming: %s", tx.Error)
-				}
+	pb.heartbeat.Do(func() {
+		// Leases are extended as long as the process lives, even after StopConsuming
+		// because in-flight tasks may still be running
+		go pb.heartbeatLoop()
+		go pb.controlLoop()
+	})
 
-				if task.UUID != "" {
-					deliveries <- task
-				}
-			}
-		}
-	}()
+	pb.wg.Add(1)
+	go pb.receive(listener, deliveries)
 
 	if err := pb.consume(deliveries, taskProcessor); err != nil {
+		// Claimed tasks which have not been delivered yet are released
+		pb.stopReceiving()
 		return pb.retry, err // retry true
 	}
 
+	// Machinery exits once StartConsuming returns,
+	// so the running tasks are waited for (see Drain)
+	<-pb.drained
+
 	return pb.retry, nil
 }
 
-// StopConsuming quits the loop
+// DrainReport describes the tasks left behind by a drain.
+type DrainReport struct {
+	// Released are the claimed tasks which had not started, they are back in their queue.
+	Released []string
+	// Abandoned are the tasks still running when the drain timeout was reached.
+	// Their leases expire once the process exits and they are delivered again.
+	Abandoned []string
+}
+
+// StopConsuming quits the loop after draining the in-flight tasks (see SetDrainTimeout)
 func (pb *Broker) StopConsuming() {
-	// Do not retry from now on
-	pb.retry = false
-	// Stop the receiving goroutine
-	pb.stopReceiving()
-	// Notifying the stop channel stops consuming of messages
-	pb.stopChan <- 1
+	pb.mu.Lock()
+	timeout := pb.drainTimeout
+	pb.mu.Unlock()
+
+	report := pb.Drain(timeout)
+	if len(report.Released) > 0 {
+		logg.Printf("Released %d unstarted tasks: %v", len(report.Released), report.Released)
+	}
+	if len(report.Abandoned) > 0 {
+		logg.Printf("Abandoned %d running tasks: %v", len(report.Abandoned), report.Abandoned)
+	}
 }
 
-// Publish places a new message on the default queue
-func (pb *Broker) Publish(task *signatures.TaskSignature) error {
-	t := NewTask()
-	if err := t.ApplySignature(task); err != nil {
-		return fmt.Errorf("Publish: %s", err)
+// Drain stops claiming new tasks, releases the claimed tasks which have not started
+// and waits for the in-flight tasks up to the given timeout.
+func (pb *Broker) Drain(timeout time.Duration) DrainReport {
+	report := DrainReport{}
+	if pb.stopReceivingChan == nil {
+		// Not consuming
+		return report
 	}
 
-	tx := DB.Begin()
-
-	count := -1
-	tx.Model(&Task{}).Where("UUID = ?", UUID(t.UUID)).Count(&count)
-	if count == 0 {
-		t.State = backends.PendingState
-		tx.Create(t)
-	} else {
-		tx.Model(t).Updates(map[string]interface{}{
-			"Name":      t.Name,
-			"GroupUUID": t.GroupUUID,
-			"RawTask":   t.RawTask,
-		})
+	// Do not retry from now on
+	pb.retry = false
+	// Stop the receiving goroutine
+	report.Released = pb.stopReceiving()
+	if err := pb.deregister(); err != nil {
+		logg.Printf("Could not deregister worker: %s", err)
 	}
+	// Closing the stop channel stops consuming of messages,
+	// Drain may be called concurrently (e.g. signal and DrainCommand)
+	pb.stopOnce.Do(func() {
+		close(pb.stopChan)
+	})
 
-	tx.Commit()
+	done := make(chan struct{})
+	go func() {
+		pb.processing.Wait()
+		close(done)
+	}()
 
-	if tx.Error != nil {
-		return fmt.Errorf("Publish: %s", tx.Error)
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		pb.mu.Lock()
+		for uuid := range pb.inFlight {
+			report.Abandoned = append(report.Abandoned, uuid)
+		}
+		pb.mu.Unlock()
 	}
 
-	return nil
+	// StartConsuming returns from now on
+	pb.drainedOnce.Do(func() {
+		close(pb.drained)
+	})
+
+	return report
+}
+
+// Publish places a new message on the queue defined by the signature's RoutingKey or on the default queue
+func (pb *Broker) Publish(task *signatures.TaskSignature) error {
+	return pb.PublishWithOptions(task)
 }
 
-// GetPendingTasks returns a slice of task.Signatures waiting in the queue
+// GetPendingTasks returns a slice of task.Signatures waiting in the queue (default queue when empty)
 func (pb *Broker) GetPendingTasks(queue string) ([]*signatures.TaskSignature, error) {
+	_, names := pb.consumed()
+	if queue == "" {
+		queue = pb.defaultQueue
+	}
 	tasks := []*Task{}
 
 	db := DB.Where("consumed = ?", false).
-		Where("name in (?)", pb.registeredTaskNames).
-		Find(tasks)
+		Where("locked_until IS NULL").
+		Where("queue in (?)", pb.withLegacyQueue([]string{queue})).
+		Where("name in (?)", names).
+		Order("created_at").
+		Find(&tasks)
 
 	if db.Error != nil {
 		return nil, fmt.Errorf("GetPendingTasks: %s", db.Error)
@@ -220,32 +331,54 @@ func (pb *Broker) GetPendingTasks(queue string) ([]*signatures.TaskSignature, er
 func (pb *Broker) consumeOne(task *Task, taskProcessor brokers.TaskProcessor) {
 	logg.Printf("Received new message: %s - %s", task.UUID, task.Name)
 
-	sig, err := task.Signature()
+	if pb.revoked(task.UUID) {
+		// Revoked before being started
+		pb.forget(task.UUID)
+		return
+	}
+
+	err := pb.process(task, taskProcessor)
+
+	// The task is acknowledged once processed so a crashed worker
+	// leaves a lease that expires and the task is delivered again
+	if ackErr := pb.ack(task, err); ackErr != nil {
+		logg.Printf("Could not acknowledge message: %s - %s", task.UUID, ackErr)
+	}
+
 	if err != nil {
-		pb.errorsChan <- err
+		select {
+		case pb.errorsChan <- err:
+		default:
+			// An error is already pending
+			logg.Printf("%s", err)
+		}
 	}
+}
 
-	if err := taskProcessor.Process(sig); err != nil {
-		pb.errorsChan <- err
+// Processes the signature of the given task
+func (pb *Broker) process(task *Task, taskProcessor brokers.TaskProcessor) error {
+	sig, err := task.Signature()
+	if err != nil {
+		return err
 	}
+
+	return taskProcessor.Process(sig)
 }
 
 // Consumes messages...
 func (pb *Broker) consume(deliveries <-chan *Task, taskProcessor brokers.TaskProcessor) error {
-	if pb.limiter == nil {
-		pb.limiter = make(chan struct{}, pb.maxParallelTasks)
-	}
-
 	for {
 		select {
 		case err := <-pb.errorsChan:
 			return err
 		case d := <-deliveries:
 			// Consume the task inside a gotourine so multiple tasks
-			// can be processed concurrently according to the limiter
-			pb.limiter <- struct{}{}
+			// can be processed concurrently according to MaxParallelTasks
+			// (the slot has been taken by the receiving goroutine)
+			pb.processing.Add(1)
 			go func() {
-				defer func() { <-pb.limiter }()
+				defer pb.processing.Done()
+				defer pb.release()
 				pb.consumeOne(d, taskProcessor)
 			}()
 		case <-pb.stopChan:
@@ -254,11 +387,161 @@ func (pb *Broker) consume(deliveries <-chan *Task, taskProcessor brokers.TaskPro
 	}
 }
 
-// Stops the receiving goroutine
-func (pb *Broker) stopReceiving() {
-	pb.stopReceivingChan <- 1
+// Receives tasks until stopReceivingChan is closed
+func (pb *Broker) receive(listener *pq.Listener, deliveries chan<- *Task) {
+	defer pb.wg.Done()
+	defer listener.Close()
+	// The ticker is only a safety net, deliveries are triggered by Publish notifications
+	ticker := time.NewTicker(FallbackPollInterval)
+	defer ticker.Stop()
+	// Fires when the next delayed task is due
+	scheduled := time.NewTimer(FallbackPollInterval)
+	defer scheduled.Stop()
+
+	fmt.Println("[*] Waiting for messages. To exit press CTRL+C")
+	for {
+		// Fetch the available tasks, as many as there are free slots,
+		// before waiting for the next notification
+		for {
+			tasks, err := pb.claimTasks(pb.freeSlots())
+			if err != nil {
+				select {
+				case pb.errorsChan <- fmt.Errorf("StartConsuming: %s", err):
+				case <-pb.stopReceivingChan:
+				}
+				return
+			}
+			if len(tasks) == 0 {
+				break
+			}
+
+			for i, task := range tasks {
+				// The slot is taken here so the next claim knows how many tasks it can fetch
+				pb.takeSlot()
+
+				select {
+				case deliveries <- task:
+				case <-pb.stopReceivingChan:
+					pb.release()
+					pb.releaseTasks(tasks[i:])
+					return
+				}
+			}
+		}
+		resetTimer(scheduled, pb.nextDelay())
+
+		select {
+		// A way to stop this goroutine from StopConsuming
+		case <-pb.stopReceivingChan:
+			return
+		case <-listener.Notify:
+		case <-pb.wakeup:
+		case <-scheduled.C:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gives back to their queue the claimed tasks which have not been delivered
+func (pb *Broker) releaseTasks(tasks []*Task) {
+	if err := releaseLeases(pb.workerID, tasks); err != nil {
+		logg.Printf("Could not release tasks: %s", err)
+		return
+	}
+
+	for _, task := range tasks {
+		pb.forget(task.UUID)
+	}
+
+	pb.mu.Lock()
+	for _, task := range tasks {
+		pb.unstarted = append(pb.unstarted, task.UUID)
+	}
+	pb.mu.Unlock()
+}
+
+// Identifies the worker owning the leases of this broker
+func newWorkerID(consumerTag string) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s:%d", consumerTag, hostname, os.Getpid())
+}
+
+// Stops the timer and resets it to the given duration
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// Returns the number of tasks that can be started
+func (pb *Broker) freeSlots() int {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.maxParallelTasks - pb.running
+}
+
+// Takes a slot for a delivered task
+func (pb *Broker) takeSlot() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.running++
+}
+
+// Frees the slot of a processed task and wakes up the receiving goroutine
+func (pb *Broker) release() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.running--
+	pb.wake()
+}
+
+// Wakes up the receiving goroutine, pb.mu must be held
+func (pb *Broker) wake() {
+	select {
+	case pb.wakeup <- struct{}{}:
+	default:
+		// A wake up is already pending (or not consuming)
+	}
+}
+
+// Returns the given queues with the empty queue of the tasks published before queues
+// when the default queue is consumed
+func (pb *Broker) withLegacyQueue(queues []string) []string {
+	for _, queue := range queues {
+		if queue == pb.defaultQueue {
+			return append([]string{""}, queues...)
+		}
+	}
+	return queues
+}
+
+// Returns the queues and the task names consumed by this broker
+func (pb *Broker) consumed() ([]string, []string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.queues, pb.registeredTaskNames
+}
+
+// Stops the receiving goroutine and returns the released tasks
+func (pb *Broker) stopReceiving() []string {
+	pb.stopReceivingOnce.Do(func() {
+		close(pb.stopReceivingChan)
+	})
 	// Waiting for the receiving goroutine to have stopped
 	pb.wg.Wait()
-	// Draining limiter channel
-	close(pb.limiter)
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	released := pb.unstarted
+	pb.unstarted = nil
+	return released
 }
@@ -0,0 +1,168 @@
+package machinerypg
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// CoalesceMode defines how publishes sharing a key are coalesced.
+type CoalesceMode string
+
+const (
+	// Debounce only runs the last publish of a burst, once no publish happened during the window.
+	Debounce CoalesceMode = "debounce"
+	// Throttle starts at most one task per interval, the publishes while a task is pending are dropped.
+	Throttle CoalesceMode = "throttle"
+)
+
+// CoalescedPublish model records a publish merged into another task (see WithDebounce and WithThrottle).
+type CoalescedPublish struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   *time.Time
+	Mode        CoalesceMode `gorm:"not null"`
+	CoalesceKey string       `gorm:"index;not null"`
+	TaskUUID    string       `gorm:"type:uuid"`  // UUID of the coalesced publish, never used by a task
+	IntoUUID    string       `gorm:"type:uuid"`  // Task which runs instead
+	RawTask     []byte       `gorm:"type:jsonb"` // Dropped signature: the replaced payload with Debounce, the publish with Throttle
+}
+
+// CoalescedPublishes returns the latest coalesced publishes of the given key (all keys when empty)
+func CoalescedPublishes(key string, limit int) ([]*CoalescedPublish, error) {
+	publishes := []*CoalescedPublish{}
+
+	db := DB.Order("id DESC").Limit(limit)
+	if key != "" {
+		db = db.Where("coalesce_key = ?", key)
+	}
+	if err := db.Find(&publishes).Error; err != nil {
+		return nil, fmt.Errorf("CoalescedPublishes: %s", err)
+	}
+	return publishes, nil
+}
+
+// coalesce merges the given task into a task of the same coalesce key, it returns the UUID of that task.
+// An empty UUID is returned when the task must be inserted, its run_at being set according to the mode.
+// Publishers of the same key are serialized until the end of the given transaction.
+func coalesce(tx *gorm.DB, t *Task, o *publishOptions) (string, error) {
+	if err := lockKey(tx, coalesceLock, *t.CoalesceKey); err != nil {
+		return "", err
+	}
+
+	switch o.coalesceMode {
+	case Debounce:
+		return debounce(tx, t, o.coalesceWindow)
+	case Throttle:
+		return throttle(tx, t, o.coalesceWindow)
+	}
+	return "", fmt.Errorf("unknown coalesce mode: %s", o.coalesceMode)
+}
+
+// debounce replaces the signature of the pending task of the same key and postpones it to the end of the window
+func debounce(tx *gorm.DB, t *Task, window time.Duration) (string, error) {
+	runAt := time.Now().UTC().Add(window)
+	if t.RunAt != nil && t.RunAt.After(runAt) {
+		runAt = *t.RunAt
+	}
+
+	pending, err := pendingCoalesced(tx, *t.CoalesceKey)
+	if err != nil {
+		return "", err
+	}
+	if pending == nil {
+		t.RunAt = &runAt
+		return "", nil
+	}
+
+	// The last publish runs with the UUID of the pending task
+	sig, err := t.Signature()
+	if err != nil {
+		return "", err
+	}
+	sig.UUID = "task_" + pending.UUID
+	raw, err := json.Marshal(sig)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Model(pending).Updates(map[string]interface{}{
+		"name":     t.Name,
+		"queue":    t.Queue,
+		"priority": t.Priority,
+		"run_at":   runAt,
+		"raw_task": raw,
+	}).Error
+	if err != nil {
+		return "", err
+	}
+
+	// The task may have moved to another queue, its consumers reschedule their wake up on commit
+	if err := notify(tx, t.Queue, pending.UUID); err != nil {
+		return "", err
+	}
+
+	// The replaced payload is the one which never runs
+	return pending.UUID, recordCoalesced(tx, Debounce, t, pending.UUID, pending.RawTask)
+}
+
+// throttle drops the task when a task of the same key is pending.
+// Otherwise the task starts at least one interval after the start of the previous task of the key.
+func throttle(tx *gorm.DB, t *Task, interval time.Duration) (string, error) {
+	pending, err := pendingCoalesced(tx, *t.CoalesceKey)
+	if err != nil {
+		return "", err
+	}
+	if pending != nil {
+		return pending.UUID, recordCoalesced(tx, Throttle, t, pending.UUID, t.RawTask)
+	}
+
+	var last struct {
+		ClaimedAt *time.Time
+	}
+	err = tx.Unscoped().Model(&Task{}).
+		Select("MAX(claimed_at) AS claimed_at").
+		Where("coalesce_key = ?", *t.CoalesceKey).
+		Scan(&last).Error
+	if err != nil {
+		return "", err
+	}
+
+	if last.ClaimedAt != nil {
+		runAt := last.ClaimedAt.UTC().Add(interval)
+		if t.RunAt == nil || t.RunAt.Before(runAt) {
+			t.RunAt = &runAt
+		}
+	}
+	return "", nil
+}
+
+// pendingCoalesced returns the not started task of the given key, nil if none
+func pendingCoalesced(tx *gorm.DB, key string) (*Task, error) {
+	pending := &Task{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("coalesce_key = ?", key).
+		Where("consumed = ?", false).
+		Where("locked_until IS NULL").
+		Order("created_at DESC").
+		First(pending).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// recordCoalesced records that the given publish has been coalesced into the given task, dropping the given signature
+func recordCoalesced(tx *gorm.DB, mode CoalesceMode, t *Task, intoUUID string, dropped []byte) error {
+	return tx.Create(&CoalescedPublish{
+		Mode:        mode,
+		CoalesceKey: *t.CoalesceKey,
+		TaskUUID:    t.UUID,
+		IntoUUID:    intoUUID,
+		RawTask:     dropped,
+	}).Error
+}
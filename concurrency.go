@@ -0,0 +1,146 @@
+package machinerypg
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Scope designates what a limit applies to.
+type Scope string
+
+const (
+	// TaskScope applies to the tasks of a given name.
+	TaskScope Scope = "task"
+	// QueueScope applies to the tasks of a given queue.
+	QueueScope Scope = "queue"
+)
+
+// ConcurrencyLimit model caps the number of tasks running at once across all the workers.
+type ConcurrencyLimit struct {
+	Scope Scope  `gorm:"primary_key"`
+	Name  string `gorm:"primary_key"`
+	Max   int    `gorm:"not null"`
+}
+
+// SetClusterConcurrency caps the number of tasks of the given task name or queue running at once across all the workers.
+func SetClusterConcurrency(scope Scope, name string, max int) error {
+	limit := &ConcurrencyLimit{Scope: scope, Name: name, Max: max}
+	err := DB.Set("gorm:insert_option", "ON CONFLICT (scope, name) DO UPDATE SET max = EXCLUDED.max").
+		Create(limit).Error
+	if err != nil {
+		return fmt.Errorf("SetClusterConcurrency: %s", err)
+	}
+	return nil
+}
+
+// RemoveClusterConcurrency removes the cluster-wide cap of the given task name or queue.
+func RemoveClusterConcurrency(scope Scope, name string) error {
+	if err := DB.Where("scope = ? AND name = ?", scope, name).Delete(&ConcurrencyLimit{}).Error; err != nil {
+		return fmt.Errorf("RemoveClusterConcurrency: %s", err)
+	}
+	return nil
+}
+
+// quota holds the number of tasks that can still be started per task name and per queue.
+// Absent names are not limited.
+type quota map[Scope]map[string]int
+
+// scope excludes from the given query the tasks which have no slot left
+func (q quota) scope(db *gorm.DB) *gorm.DB {
+	if names := q.exhausted(TaskScope); len(names) > 0 {
+		db = db.Where("name not in (?)", names)
+	}
+	if queues := q.exhausted(QueueScope); len(queues) > 0 {
+		db = db.Where("queue not in (?)", queues)
+	}
+	return db
+}
+
+// take uses a slot for the given task, it returns false when there is no slot left
+func (q quota) take(task *Task) bool {
+	keys := map[Scope]string{TaskScope: task.Name, QueueScope: task.Queue}
+	for scope, name := range keys {
+		if n, ok := q[scope][name]; ok && n <= 0 {
+			return false
+		}
+	}
+
+	for scope, name := range keys {
+		if _, ok := q[scope][name]; ok {
+			q[scope][name]--
+		}
+	}
+	return true
+}
+
+func (q quota) exhausted(scope Scope) []string {
+	names := []string{}
+	for name, n := range q[scope] {
+		if n <= 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// limit lowers the slots of the given name to n
+func (q quota) limit(scope Scope, name string, n int) {
+	if current, ok := q[scope][name]; !ok || n < current {
+		q[scope][name] = n
+	}
+}
+
+// concurrencyQuota computes the slots left according to the local and the cluster-wide caps.
+// The cluster-wide limits are locked until the end of the given transaction,
+// so concurrent workers claim their tasks one after the other.
+func (pb *Broker) concurrencyQuota(tx *gorm.DB) (quota, error) {
+	queues, names := pb.consumed()
+	q := quota{TaskScope: {}, QueueScope: {}}
+
+	// Local caps
+	pb.mu.Lock()
+	running := quota{TaskScope: {}, QueueScope: {}}
+	for _, task := range pb.inFlight {
+		running[TaskScope][task.Name]++
+		running[QueueScope][task.Queue]++
+	}
+	for scope, caps := range pb.concurrency {
+		for name, max := range caps {
+			q.limit(scope, name, max-running[scope][name])
+		}
+	}
+	pb.mu.Unlock()
+
+	// Cluster-wide caps
+	limits := []*ConcurrencyLimit{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("(scope = ? AND name in (?)) OR (scope = ? AND name in (?))",
+			TaskScope, names,
+			QueueScope, queues).
+		Find(&limits).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, limit := range limits {
+		column := "name"
+		if limit.Scope == QueueScope {
+			column = "queue"
+		}
+
+		count := 0
+		err := tx.Model(&Task{}).
+			Where("consumed = ?", false).
+			Where("locked_until > now()").
+			Where(column+" = ?", limit.Name).
+			Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+
+		q.limit(limit.Scope, limit.Name, limit.Max-count)
+	}
+
+	return q, nil
+}
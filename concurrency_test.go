@@ -0,0 +1,123 @@
+package machinerypg
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestQuotaTake(t *testing.T) {
+	task := &Task{Name: "send_email", Queue: "emails"}
+
+	tests := []struct {
+		name     string
+		quota    quota
+		expected bool
+		left     quota
+	}{
+		{
+			name:     "not limited",
+			quota:    quota{TaskScope: {}, QueueScope: {}},
+			expected: true,
+			left:     quota{TaskScope: {}, QueueScope: {}},
+		},
+		{
+			name:     "task name limited",
+			quota:    quota{TaskScope: {"send_email": 2}, QueueScope: {}},
+			expected: true,
+			left:     quota{TaskScope: {"send_email": 1}, QueueScope: {}},
+		},
+		{
+			name:     "queue limited",
+			quota:    quota{TaskScope: {}, QueueScope: {"emails": 1}},
+			expected: true,
+			left:     quota{TaskScope: {}, QueueScope: {"emails": 0}},
+		},
+		{
+			name:     "both limited",
+			quota:    quota{TaskScope: {"send_email": 3}, QueueScope: {"emails": 1}},
+			expected: true,
+			left:     quota{TaskScope: {"send_email": 2}, QueueScope: {"emails": 0}},
+		},
+		{
+			name:     "task name exhausted",
+			quota:    quota{TaskScope: {"send_email": 0}, QueueScope: {"emails": 1}},
+			expected: false,
+			left:     quota{TaskScope: {"send_email": 0}, QueueScope: {"emails": 1}},
+		},
+		{
+			name:     "queue exhausted",
+			quota:    quota{TaskScope: {"send_email": 1}, QueueScope: {"emails": 0}},
+			expected: false,
+			left:     quota{TaskScope: {"send_email": 1}, QueueScope: {"emails": 0}},
+		},
+		{
+			name:     "overdrawn",
+			quota:    quota{TaskScope: {"send_email": -1}, QueueScope: {}},
+			expected: false,
+			left:     quota{TaskScope: {"send_email": -1}, QueueScope: {}},
+		},
+		{
+			name:     "other names",
+			quota:    quota{TaskScope: {"send_sms": 0}, QueueScope: {"sms": 0}},
+			expected: true,
+			left:     quota{TaskScope: {"send_sms": 0}, QueueScope: {"sms": 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := tt.quota.take(task); ok != tt.expected {
+				t.Errorf("take() = %t, expected %t", ok, tt.expected)
+			}
+			if !reflect.DeepEqual(tt.quota, tt.left) {
+				t.Errorf("quota = %v, expected %v", tt.quota, tt.left)
+			}
+		})
+	}
+}
+
+func TestQuotaLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		quota    quota
+		n        int
+		expected int
+	}{
+		{"not limited", quota{TaskScope: {}}, 5, 5},
+		{"lower", quota{TaskScope: {"send_email": 5}}, 2, 2},
+		{"higher", quota{TaskScope: {"send_email": 2}}, 5, 2},
+		{"negative", quota{TaskScope: {"send_email": 2}}, -1, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.quota.limit(TaskScope, "send_email", tt.n)
+			if n := tt.quota[TaskScope]["send_email"]; n != tt.expected {
+				t.Errorf("limit(%d) = %d, expected %d", tt.n, n, tt.expected)
+			}
+		})
+	}
+}
+
+func TestQuotaExhausted(t *testing.T) {
+	tests := []struct {
+		name     string
+		quota    quota
+		expected []string
+	}{
+		{"not limited", quota{TaskScope: {}, QueueScope: {}}, []string{}},
+		{"slots left", quota{TaskScope: {"send_email": 1}, QueueScope: {"emails": 0}}, []string{}},
+		{"exhausted", quota{TaskScope: {"send_email": 0, "send_sms": 1, "resize": -2}, QueueScope: {}}, []string{"resize", "send_email"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := tt.quota.exhausted(TaskScope)
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("exhausted() = %v, expected %v", names, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package machinerypg
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// CommandKind is the action of a control command.
+type CommandKind string
+
+const (
+	// ResizeCommand sets the maximum number of tasks processed at once, Arg is the new maximum.
+	ResizeCommand CommandKind = "resize"
+	// DrainCommand stops consuming like StopConsuming.
+	DrainCommand CommandKind = "drain"
+	// StopQueueCommand stops consuming the queue given as Arg.
+	StopQueueCommand CommandKind = "stop_queue"
+	// ReloadTasksCommand reloads the registered task names (see Broker.SetTaskReloader).
+	ReloadTasksCommand CommandKind = "reload_tasks"
+)
+
+// Command model is a control command sent to the workers.
+type Command struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt *time.Time
+	Target    string      `gorm:"index"` // Worker ID (see Workers), all the workers when empty
+	Kind      CommandKind `gorm:"not null"`
+	Arg       string
+}
+
+// CommandAck model records the execution of a command by a worker.
+type CommandAck struct {
+	CommandID uint   `gorm:"primary_key;auto_increment:false"`
+	WorkerID  string `gorm:"primary_key"`
+	AckedAt   *time.Time
+	Error     string // Empty when applied successfully
+}
+
+// SendCommand sends a command to the given worker, or to all the live workers when target is empty.
+// Workers only apply the commands sent after they started consuming.
+func SendCommand(target string, kind CommandKind, arg string) (*Command, error) {
+	cmd := &Command{Target: target, Kind: kind, Arg: arg}
+
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return nil, fmt.Errorf("SendCommand: %s", tx.Error)
+	}
+
+	// Created by the database clock like the started_at of the workers, both are compared by applyCommands
+	err := tx.Raw("INSERT INTO commands (created_at, target, kind, arg) VALUES (now(), ?, ?, ?) RETURNING *", target, kind, arg).
+		Scan(cmd).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("SendCommand: %s", err)
+	}
+
+	// The notification is sent on commit
+	if err := tx.Exec("SELECT pg_notify(?, ?)", controlChannel, strconv.Itoa(int(cmd.ID))).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("SendCommand: %s", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("SendCommand: %s", err)
+	}
+	return cmd, nil
+}
+
+// CommandAcks returns the acknowledgements of the given command
+func CommandAcks(commandID uint) ([]*CommandAck, error) {
+	acks := []*CommandAck{}
+	if err := DB.Where("command_id = ?", commandID).Order("acked_at").Find(&acks).Error; err != nil {
+		return nil, fmt.Errorf("CommandAcks: %s", err)
+	}
+	return acks, nil
+}
+
+// SetTaskReloader sets the function returning the task names to consume on a ReloadTasksCommand
+func (pb *Broker) SetTaskReloader(reload func() ([]string, error)) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.reloadTasks = reload
+}
+
+// controlLoop applies the control commands and the revocations sent to this broker
+func (pb *Broker) controlLoop() {
+	listener, err := newListener(pb.url, controlChannel, revokeChannel)
+	if err != nil {
+		logg.Printf("Control commands are not received: %s", err)
+		return
+	}
+	defer listener.Close()
+
+	for n := range listener.Notify {
+		if n != nil && n.Channel == revokeChannel {
+			pb.cancelTask(n.Extra)
+			continue
+		}
+
+		// After a reconnection (nil notification) the missed commands are applied as well
+		if err := pb.applyCommands(); err != nil {
+			logg.Printf("Could not apply commands: %s", err)
+		}
+	}
+}
+
+// applyCommands applies the pending commands of this broker and acknowledges them
+func (pb *Broker) applyCommands() error {
+	pb.mu.Lock()
+	consuming := pb.consumerTag != ""
+	pb.mu.Unlock()
+
+	if !consuming {
+		return nil
+	}
+
+	commands := []*Command{}
+	err := DB.Where("target = '' OR target = ?", pb.workerID).
+		Where("created_at >= (SELECT started_at FROM workers WHERE id = ?)", pb.workerID).
+		Where("NOT EXISTS (SELECT 1 FROM command_acks WHERE command_acks.command_id = commands.id AND command_acks.worker_id = ?)", pb.workerID).
+		Order("id").
+		Find(&commands).Error
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range commands {
+		ackErr := ""
+		if err := pb.applyCommand(cmd); err != nil {
+			ackErr = err.Error()
+		}
+		logg.Printf("Applied command %d %s(%s): %s", cmd.ID, cmd.Kind, cmd.Arg, ackErr)
+
+		// An already acknowledged command is ignored
+		err := DB.Exec("INSERT INTO command_acks (command_id, worker_id, acked_at, error) VALUES (?, ?, now(), ?) ON CONFLICT DO NOTHING",
+			cmd.ID, pb.workerID, ackErr).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyCommand applies the given command to this broker
+func (pb *Broker) applyCommand(cmd *Command) error {
+	switch cmd.Kind {
+	case ResizeCommand:
+		n, err := strconv.Atoi(cmd.Arg)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid maximum: %s", cmd.Arg)
+		}
+		pb.SetMaxParallelTasks(n)
+	case DrainCommand:
+		// Draining waits for the running tasks, the command is acknowledged meanwhile
+		go pb.StopConsuming()
+		return nil
+	case StopQueueCommand:
+		queues, _ := pb.consumed()
+		remaining := make([]string, 0, len(queues))
+		for _, queue := range queues {
+			if queue != cmd.Arg {
+				remaining = append(remaining, queue)
+			}
+		}
+		if len(remaining) == len(queues) {
+			return fmt.Errorf("queue not consumed: %s", cmd.Arg)
+		}
+		pb.SetQueues(remaining...)
+	case ReloadTasksCommand:
+		pb.mu.Lock()
+		reload := pb.reloadTasks
+		pb.mu.Unlock()
+
+		if reload == nil {
+			return fmt.Errorf("no task reloader")
+		}
+		names, err := reload()
+		if err != nil {
+			return err
+		}
+		pb.SetRegisteredTaskNames(names)
+	default:
+		return fmt.Errorf("unknown command: %s", cmd.Kind)
+	}
+
+	// Settings are updated in the workers table right away
+	return pb.heartbeatWorker()
+}
+
+// deleteOldCommands removes the commands older than 24 hours
+func deleteOldCommands() {
+	limit := time.Now().UTC().Add(-24 * time.Hour)
+	DB.Where("command_id IN (SELECT id FROM commands WHERE created_at < ?)", limit).
+		Delete(&CommandAck{})
+	DB.Where("created_at < ?", limit).
+		Delete(&Command{})
+}
@@ -0,0 +1,160 @@
+package machinerypg
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/jinzhu/gorm"
+)
+
+// DeadLetter model represents a task that failed permanently.
+// The task itself stays in FAILURE state so the result backend still knows it.
+type DeadLetter struct {
+	CreatedAt *time.Time // Time of the move to the dead letters
+
+	TaskUUID    string  `gorm:"primary_key;type:uuid"`
+	Name        string  `gorm:"index"`
+	Queue       string  `gorm:"index"`
+	GroupUUID   *string `gorm:"type:uuid"`
+	RawTask     []byte  `gorm:"type:jsonb"`
+	Error       string
+	Attempts    int
+	PublishedAt *time.Time
+	FailedAt    *time.Time // Time of the last attempt
+}
+
+// Signature returns the signature of the dead task
+func (dl *DeadLetter) Signature() (*signatures.TaskSignature, error) {
+	task := &signatures.TaskSignature{}
+	if err := json.Unmarshal(dl.RawTask, task); err != nil {
+		return nil, fmt.Errorf("Signature: %s", err)
+	}
+	return task, nil
+}
+
+// DeadLetters returns the last dead letters of the given queue (all queues when empty).
+// All the dead letters are returned when limit is not positive.
+func DeadLetters(queue string, limit int) ([]*DeadLetter, error) {
+	db := DB.Order("created_at DESC")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+	if queue != "" {
+		db = db.Where("queue = ?", queue)
+	}
+
+	dls := []*DeadLetter{}
+	if err := db.Find(&dls).Error; err != nil {
+		return nil, fmt.Errorf("DeadLetters: %s", err)
+	}
+	return dls, nil
+}
+
+// GetDeadLetter returns the dead letter of the given task
+func GetDeadLetter(taskUUID string) (*DeadLetter, error) {
+	dl := &DeadLetter{}
+	if err := DB.Where("task_uuid = ?", UUID(taskUUID)).First(dl).Error; err != nil {
+		return nil, fmt.Errorf("GetDeadLetter: %s", err)
+	}
+	return dl, nil
+}
+
+// RequeueDeadLetter publishes again the given dead task with a fresh attempts budget.
+// ErrTaskNotUnique is returned for a unique task while an equivalent one is pending or running (see WithUnique).
+func RequeueDeadLetter(taskUUID string) error {
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("RequeueDeadLetter: %s", tx.Error)
+	}
+
+	dl := &DeadLetter{}
+	if err := tx.Where("task_uuid = ?", UUID(taskUUID)).First(dl).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("RequeueDeadLetter: %s", err)
+	}
+
+	err := tx.Model(&Task{}).
+		Where("uuid = ?", dl.TaskUUID).
+		Updates(map[string]interface{}{
+			"consumed":     false,
+			"attempts":     0,
+			"locked_until": nil,
+			"locked_by":    "",
+			"run_at":       nil,
+			"last_error":   "",
+			"state":        backends.PendingState,
+			"error":        "",
+		}).Error
+	if isUniqueViolation(err, uniqueKeyIndex) {
+		// An equivalent unique task is pending or running
+		tx.Rollback()
+		return ErrTaskNotUnique
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("RequeueDeadLetter: %s", err)
+	}
+
+	if err := tx.Delete(dl).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("RequeueDeadLetter: %s", err)
+	}
+
+	if err := notify(tx, dl.Queue, dl.TaskUUID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("RequeueDeadLetter: %s", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("RequeueDeadLetter: %s", err)
+	}
+	return nil
+}
+
+// DiscardDeadLetter deletes the dead letter of the given task
+func DiscardDeadLetter(taskUUID string) error {
+	uuid := UUID(taskUUID)
+	if uuid == "" {
+		return fmt.Errorf("DiscardDeadLetter: empty task UUID")
+	}
+
+	// An explicit condition, gorm deletes all the rows when the primary key is blank
+	if err := DB.Where("task_uuid = ?", uuid).Delete(&DeadLetter{}).Error; err != nil {
+		return fmt.Errorf("DiscardDeadLetter: %s", err)
+	}
+	return nil
+}
+
+// deadLetter moves the given task to the dead letters and marks it as failed
+func deadLetter(db *gorm.DB, task *Task, reason string) error {
+	dl := &DeadLetter{
+		TaskUUID:    task.UUID,
+		Name:        task.Name,
+		Queue:       task.Queue,
+		GroupUUID:   task.GroupUUID,
+		RawTask:     task.RawTask,
+		Error:       reason,
+		Attempts:    task.Attempts,
+		PublishedAt: task.CreatedAt,
+		FailedAt:    task.UpdatedAt,
+	}
+
+	// The task may have been dead and requeued before
+	if err := db.Where("task_uuid = ?", task.UUID).Delete(&DeadLetter{}).Error; err != nil {
+		return err
+	}
+	if err := db.Create(dl).Error; err != nil {
+		return err
+	}
+
+	return db.Model(task).Updates(map[string]interface{}{
+		"consumed":     true,
+		"locked_until": nil,
+		"locked_by":    "",
+		"state":        backends.FailureState,
+		"error":        reason,
+	}).Error
+}
@@ -0,0 +1,342 @@
+package machinerypg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// claimTasks claims up to limit unconsumed tasks, the oldest first.
+// Rows locked by another worker are skipped so concurrent workers never wait on each other.
+// A claimed task is leased to the worker for LeaseDuration, tasks with an expired lease are claimed again
+// unless they exhausted their retry policy, then they are moved to the dead letters.
+func (pb *Broker) claimTasks(limit int) ([]*Task, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	queues, names := pb.consumed()
+
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	quota, err := pb.concurrencyQuota(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	buckets, err := pb.refillBuckets(tx, quota)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	tasks := make([]*Task, 0, limit)
+	err = unpaused(quota.scope(tx)).
+		Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("consumed = ?", false).
+		Where(claimableCondition()).
+		Where(orderingCondition).
+		Where("raw_task != '{}'").
+		Where("run_at IS NULL OR run_at <= now()").
+		Where("queue in (?)", pb.withLegacyQueue(queues)).
+		Where("name in (?)", names).
+		Where("target_worker in ('', ?)", pb.workerID).
+		Order(priorityOrder()).
+		Order("created_at").
+		Limit(limit).
+		Find(&tasks).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if len(tasks) == 0 {
+		tx.Rollback()
+		return nil, nil
+	}
+
+	claimed := tasks[:0]
+	uuids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		if task.LockedUntil != nil && task.Attempts >= maxDeliveries(task.Name) {
+			if err := deadLetter(tx, task, "task lost by its worker"); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			continue
+		}
+		if !quota.take(task) {
+			// Left for later, the row is unlocked on commit
+			continue
+		}
+
+		claimed = append(claimed, task)
+		uuids = append(uuids, task.UUID)
+	}
+	tasks = claimed
+
+	if len(tasks) == 0 {
+		return nil, tx.Commit().Error
+	}
+
+	if err := consumeTokens(tx, buckets, tasks); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Model(&Task{}).
+		Where("uuid in (?)", uuids).
+		Updates(map[string]interface{}{
+			"locked_until": leaseExpr(),
+			"locked_by":    pb.workerID,
+			"claimed_at":   gorm.Expr("now()"),
+			"attempts":     gorm.Expr("attempts + 1"),
+		}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Tracked before the commit so a revocation notified right after it is not missed
+	pb.mu.Lock()
+	for _, task := range tasks {
+		pb.inFlight[task.UUID] = task
+		pb.contexts[task.UUID] = newTaskContext()
+	}
+	pb.mu.Unlock()
+
+	if err := tx.Commit().Error; err != nil {
+		for _, task := range tasks {
+			pb.forget(task.UUID)
+		}
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// ack releases the lease of a processed task.
+// A failed task (processing error or FAILURE state) is moved to the dead letters.
+// A processing error is retried according to the task's retry policy unless Machinery retries the task itself
+// (RetryCount) or already stored its final state, which is not overwritten.
+// Otherwise the task is marked as consumed.
+// Nothing is done when the lease has been lost: the task was claimed by another worker or re-published (e.g. by a Machinery retry).
+func (pb *Broker) ack(task *Task, processErr error) error {
+	pb.forget(task.UUID)
+
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	current := NewTask()
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("uuid = ?", task.UUID).
+		Where("locked_by = ?", pb.workerID).
+		First(current).Error
+	if err == gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	reason := current.Error
+	if processErr != nil {
+		reason = processErr.Error()
+	}
+
+	policy := retryPolicy(current.Name)
+	switch {
+	case processErr == nil && current.State != backends.FailureState:
+		err = tx.Model(current).Updates(map[string]interface{}{
+			"consumed":     true,
+			"locked_until": nil,
+			"locked_by":    "",
+		}).Error
+	case processErr != nil && retriable(task, current) && !policy.Exhausted(current.Attempts):
+		err = retry(tx, current, reason, policy.Backoff(current.Attempts))
+	default:
+		err = deadLetter(tx, current, reason)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// retriable returns whether the database can retry the given claimed task, in its current state
+func retriable(claimed, current *Task) bool {
+	if current.State == backends.SuccessState || current.State == backends.FailureState {
+		// Clients and callbacks have already seen the final state
+		return false
+	}
+	sig, err := claimed.Signature()
+	// Machinery re-publishes the task itself
+	return err == nil && sig.RetryCount == 0
+}
+
+// retry releases the lease of the given task and schedules its next attempt after the given delay
+func retry(db *gorm.DB, task *Task, reason string, delay time.Duration) error {
+	runAt := time.Now().UTC().Add(delay)
+	err := db.Model(task).Updates(map[string]interface{}{
+		"locked_until": nil,
+		"locked_by":    "",
+		"run_at":       &runAt,
+		"last_error":   reason,
+		"state":        backends.PendingState,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// Consumers reschedule their wake up according to the new run_at
+	return notify(db, task.Queue, task.UUID)
+}
+
+// releaseLeases gives back the given tasks to their queue without counting an attempt
+func releaseLeases(workerID string, tasks []*Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	queues := map[string]bool{}
+	uuids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		uuids = append(uuids, task.UUID)
+		queues[task.Queue] = true
+	}
+
+	err := tx.Model(&Task{}).
+		Where("uuid in (?)", uuids).
+		Where("locked_by = ?", workerID).
+		Updates(map[string]interface{}{
+			"locked_until": nil,
+			"locked_by":    "",
+			"attempts":     gorm.Expr("attempts - 1"),
+		}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Other workers can take them right away
+	for queue := range queues {
+		if err := notify(tx, queue, ""); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// leaseExpr returns the end of a new lease, computed by Postgres to avoid clock drifts between workers
+func leaseExpr() interface{} {
+	return gorm.Expr("now() + ? * interval '1 second'", LeaseDuration.Seconds())
+}
+
+// nextDelay returns the duration until the next delayed task is due
+// or until a rate limited task can be started.
+// It is bounded by FallbackPollInterval.
+func (pb *Broker) nextDelay() time.Duration {
+	queues, names := pb.consumed()
+	delay := FallbackPollInterval
+
+	var runAt pq.NullTime
+	err := DB.Model(&Task{}).
+		Select("MIN(run_at)").
+		Where("consumed = ?", false).
+		Where("run_at > now()").
+		Where("queue in (?)", pb.withLegacyQueue(queues)).
+		Where("name in (?)", names).
+		Row().
+		Scan(&runAt)
+	if err == nil && runAt.Valid {
+		if d := runAt.Time.Sub(time.Now()); d < delay {
+			delay = d
+		}
+	}
+
+	if d, ok := pb.nextRefill(); ok && d < delay {
+		delay = d
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// heartbeatLoop periodically extends the leases of the in-flight tasks and refreshes the worker registration
+func (pb *Broker) heartbeatLoop() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := pb.extendLeases(); err != nil {
+			logg.Printf("Could not extend leases: %s", err)
+		}
+		if err := pb.heartbeatWorker(); err != nil {
+			logg.Printf("Could not refresh worker: %s", err)
+		}
+	}
+}
+
+// extendLeases renews the leases of the tasks owned by this worker
+func (pb *Broker) extendLeases() error {
+	pb.mu.Lock()
+	uuids := make([]string, 0, len(pb.inFlight))
+	for uuid := range pb.inFlight {
+		uuids = append(uuids, uuid)
+	}
+	pb.mu.Unlock()
+
+	if len(uuids) == 0 {
+		return nil
+	}
+
+	return DB.Model(&Task{}).
+		Where("uuid in (?)", uuids).
+		Where("locked_by = ?", pb.workerID).
+		Update("locked_until", leaseExpr()).Error
+}
+
+// priorityOrder returns the SQL ordering on the priority of the tasks.
+// With PriorityAging, a task gains one priority level per elapsed PriorityAging.
+func priorityOrder() string {
+	aging := int64(PriorityAging.Seconds())
+	if aging <= 0 {
+		return "priority DESC"
+	}
+	return fmt.Sprintf("priority + FLOOR(EXTRACT(EPOCH FROM now() - created_at) / %d) DESC", aging)
+}
+
+// orderingCondition is the SQL condition of the tasks not preceded by an unfinished task of the same ordering key
+const orderingCondition = `ordering_key IS NULL OR NOT EXISTS (
+	SELECT 1 FROM tasks previous
+	WHERE previous.ordering_key = tasks.ordering_key AND previous.seq < tasks.seq AND NOT previous.consumed AND previous.deleted_at IS NULL)`
+
+// claimableCondition returns the SQL condition on the lease of a task that can be claimed
+func claimableCondition() string {
+	if LostTasksPolicy == FailLostTasks {
+		// Tasks with an expired lease are left to the reaper
+		return "locked_until IS NULL"
+	}
+	return "locked_until IS NULL OR locked_until < now()"
+}
@@ -29,6 +29,7 @@ func init() {
 	err = machinerypg.MigrateBroker(cnf.Broker)
 	check(err)
 	machinerypg.StartCleanupRoutine()
+	machinerypg.StartReaperRoutine()
 
 	// Server instanciation
 	cnf.Broker = "eager://"
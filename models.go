@@ -1,6 +1,7 @@
 package machinerypg
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -29,6 +30,17 @@ func GUUID(groupUUID string) string {
 	return strings.Replace(groupUUID, "group_", "", -1)
 }
 
+// NewUUID generates a random (version 4) UUID
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("NewUUID: %s", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // Variant RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
 // Task model represents the Machinery's signatures.TaskSignature in Postgres
 type Task struct {
 	// gorm.Model without ID field
@@ -37,13 +49,29 @@ type Task struct {
 	DeletedAt *time.Time
 
 	// signatures.TaskSignature
-	UUID      string `gorm:"primary_key;type:uuid"`
-	Name      string
-	GroupUUID *string `gorm:"index;type:uuid"` // *string can be nil/NULL
+	UUID        string `gorm:"primary_key;type:uuid"`
+	Name        string
+	GroupUUID   *string `gorm:"index;type:uuid"`           // *string can be nil/NULL
+	Queue       string  `gorm:"index;not null;default:''"` // Empty for the tasks published before queues, see Broker.SetQueues
+	DedupKey    *string `gorm:"unique_index"`              // Deduplication key, see WithDedupKey
+	UniqueKey   *string // Uniqueness key of the pending or running tasks, see WithUnique
+	Broadcast   bool    `gorm:"not null;default:false"`                                         // Aggregates the per worker tasks, see PublishBroadcast
+	ParentUUID  *string `gorm:"index;type:uuid"`                                                // Broadcast task of a per worker task
+	OrderingKey *string `gorm:"index:idx_tasks_ordering"`                                       // Tasks sharing a key run one at a time, see WithOrderingKey
+	Seq         int64   `gorm:"index:idx_tasks_ordering;not null;default:nextval('tasks_seq')"` // Publish order
+	CoalesceKey *string `gorm:"index"`                                                          // Publishes sharing a key are debounced or throttled, see WithDebounce
 
 	// Broker
-	Consumed bool
-	RawTask  []byte `gorm:"type:jsonb"` // try *json.RawMessage -> https://github.com/lib/pq/issues/437
+	Consumed     bool
+	Priority     int        `gorm:"index;not null;default:0"` // Higher priorities are consumed first
+	Attempts     int        `gorm:"not null;default:0"`       // Number of deliveries
+	LastError    string     // Error of the last failed attempt
+	RunAt        *time.Time `gorm:"index"` // The task is not consumed before this time (signature's ETA)
+	LockedUntil  *time.Time `gorm:"index"` // Lease of the worker processing the task
+	LockedBy     string     // Worker owning the lease
+	ClaimedAt    *time.Time // Start of the last delivery
+	TargetWorker string     `gorm:"index;not null;default:''"` // Only this worker consumes the task when not empty
+	RawTask      []byte     `gorm:"type:jsonb"`                // try *json.RawMessage -> https://github.com/lib/pq/issues/437
 
 	// Backend
 	State  string `gorm:"index;not null"` // backend - ENUM type is not supportted by libpq
@@ -73,6 +101,12 @@ func (t *Task) ApplySignature(task *signatures.TaskSignature) error {
 	t.UUID = UUID(task.UUID)
 	t.Name = task.Name
 	t.GroupUUID = NGUUID(task.GroupUUID)
+	t.Queue = task.RoutingKey
+	t.Priority = headerInt(task.Headers, "priority")
+	if task.ETA != nil {
+		eta := task.ETA.UTC()
+		t.RunAt = &eta
+	}
 
 	raw, err := json.Marshal(task)
 	if err != nil {
@@ -83,6 +117,19 @@ func (t *Task) ApplySignature(task *signatures.TaskSignature) error {
 	return nil
 }
 
+// headerInt returns the integer value of the given header, or 0 if not an integer
+func headerInt(headers signatures.Headers, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64: // JSON numbers
+		return int(v)
+	}
+	return 0
+}
+
 // Signature returns the signature object serialzed in this Task Model
 // It returns an error if unmarshalization fails
 func (t *Task) Signature() (*signatures.TaskSignature, error) {
@@ -100,7 +147,11 @@ func (t *Task) TaskState() *backends.TaskState {
 		State:    t.State,
 	}
 
-	if taskState.State == backends.SuccessState {
+	if taskState.State == RevokedState {
+		// Machinery only knows about completed tasks in SUCCESS or FAILURE
+		taskState.State = backends.FailureState
+		taskState.Error = t.Error
+	} else if taskState.State == backends.SuccessState {
 		taskState.Result = t.UnmarshalResult()
 	} else if taskState.State == backends.FailureState {
 		taskState.Error = t.Error
@@ -0,0 +1,66 @@
+package machinerypg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+const (
+	notifyChannelPrefix = "machinery_pg_"
+	schedulesChannel    = "machinery_pg$schedules"
+	revokeChannel       = "machinery_pg$revoke"
+	controlChannel      = "machinery_pg$control"
+)
+
+// maxIdentifierLength is the maximum length in bytes of a Postgres identifier such as a channel name
+const maxIdentifierLength = 63
+
+// notifyChannel returns the LISTEN/NOTIFY channel name of the given queue.
+// Long queue names are hashed since pg_notify rejects the names longer than an identifier.
+func notifyChannel(queue string) string {
+	channel := notifyChannelPrefix + queue
+	if len(channel) <= maxIdentifierLength {
+		return channel
+	}
+
+	sum := sha256.Sum256([]byte(queue))
+	return notifyChannelPrefix + hex.EncodeToString(sum[:16])
+}
+
+// notify sends a notification on the channel of the given queue.
+// When db is a transaction, the notification is only delivered on commit.
+func notify(db *gorm.DB, queue, payload string) error {
+	return db.Exec("SELECT pg_notify(?, ?)", notifyChannel(queue), payload).Error
+}
+
+// notifySchedulers wakes up the schedulers after a change of the schedules
+func notifySchedulers(db *gorm.DB) error {
+	return db.Exec("SELECT pg_notify(?, '')", schedulesChannel).Error
+}
+
+// notifyRevocation signals the workers that the given task has been revoked
+func notifyRevocation(db *gorm.DB, taskUUID string) error {
+	return db.Exec("SELECT pg_notify(?, ?)", revokeChannel, taskUUID).Error
+}
+
+// newListener opens a dedicated connection listening the given channels
+func newListener(url string, channels ...string) (*pq.Listener, error) {
+	listener := pq.NewListener(url, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logg.Printf("Listener: %s", err)
+		}
+	})
+
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("newListener: %s", err)
+		}
+	}
+	return listener, nil
+}
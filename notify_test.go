@@ -0,0 +1,48 @@
+package machinerypg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNotifyChannel(t *testing.T) {
+	tests := []struct {
+		name   string
+		queue  string
+		hashed bool
+	}{
+		{"default queue", "", false},
+		{"short", "machinery_tasks", false},
+		{"at the limit", strings.Repeat("q", maxIdentifierLength-len(notifyChannelPrefix)), false},
+		{"over the limit", strings.Repeat("q", maxIdentifierLength-len(notifyChannelPrefix)+1), true},
+		{"long", strings.Repeat("queue", 100), true},
+		{"multibyte", strings.Repeat("é", 26), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel := notifyChannel(tt.queue)
+			if len(channel) > maxIdentifierLength {
+				t.Errorf("len(notifyChannel()) = %d, expected at most %d", len(channel), maxIdentifierLength)
+			}
+			if !strings.HasPrefix(channel, notifyChannelPrefix) {
+				t.Errorf("notifyChannel() = %s, expected prefix %s", channel, notifyChannelPrefix)
+			}
+			if hashed := channel != notifyChannelPrefix+tt.queue; hashed != tt.hashed {
+				t.Errorf("notifyChannel() = %s, expected hashed %t", channel, tt.hashed)
+			}
+			if again := notifyChannel(tt.queue); again != channel {
+				t.Errorf("notifyChannel() = %s then %s, expected the same channel", channel, again)
+			}
+		})
+	}
+}
+
+func TestNotifyChannelDistinct(t *testing.T) {
+	prefix := strings.Repeat("q", maxIdentifierLength)
+	a := notifyChannel(prefix + "a")
+	b := notifyChannel(prefix + "b")
+	if a == b {
+		t.Errorf("notifyChannel() = %s for two queues sharing a long prefix, expected distinct channels", a)
+	}
+}
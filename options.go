@@ -0,0 +1,199 @@
+package machinerypg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/lib/pq"
+)
+
+// DefaultDedupWindow is the period during which a deduplication key prevents publishing the same task again.
+var DefaultDedupWindow = 10 * time.Minute
+
+// ErrTaskNotUnique is returned when publishing a unique task while an equivalent one is pending or running (see WithUnique).
+var ErrTaskNotUnique = errors.New("task not unique")
+
+// uniqueKeyIndex is the partial unique index enforcing WithUnique
+const uniqueKeyIndex = "uix_tasks_unique_key"
+
+// isUniqueViolation returns true when the given error is a violation of the given unique index
+func isUniqueViolation(err error, index string) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == index
+}
+
+// UniqueMode defines what happens when publishing a unique task while an equivalent one is pending or running.
+type UniqueMode int
+
+const (
+	// RejectDuplicates fails the publishing with ErrTaskNotUnique.
+	RejectDuplicates UniqueMode = iota
+	// MergeDuplicates publishes nothing and sets the signature's UUID to the UUID of the equivalent task.
+	MergeDuplicates
+)
+
+// PublishOption customizes the way a task is published.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	priority       *int
+	dedupKey       string
+	dedupHash      bool
+	dedupWindow    time.Duration
+	unique         bool
+	uniqueArgs     bool
+	uniqueMode     UniqueMode
+	orderingKey    string
+	coalesceKey    string
+	coalesceMode   CoalesceMode
+	coalesceWindow time.Duration
+}
+
+func newPublishOptions(opts []PublishOption) *publishOptions {
+	o := &publishOptions{
+		dedupWindow: DefaultDedupWindow,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// apply sets the options on the given task
+func (o *publishOptions) apply(t *Task, sig *signatures.TaskSignature) error {
+	if o.priority != nil {
+		t.Priority = *o.priority
+	}
+
+	if o.dedupHash {
+		key, err := hashSignature(sig)
+		if err != nil {
+			return err
+		}
+		t.DedupKey = &key
+	} else if o.dedupKey != "" {
+		key := o.dedupKey
+		t.DedupKey = &key
+	}
+
+	if o.uniqueArgs {
+		key, err := hashSignature(sig)
+		if err != nil {
+			return err
+		}
+		t.UniqueKey = &key
+	} else if o.unique {
+		key := sig.Name
+		t.UniqueKey = &key
+	}
+
+	if o.orderingKey != "" {
+		key := o.orderingKey
+		t.OrderingKey = &key
+	}
+
+	if o.coalesceKey != "" {
+		key := o.coalesceKey
+		t.CoalesceKey = &key
+	}
+
+	return nil
+}
+
+// WithPriority sets the priority of the task, overriding the signature's "priority" header.
+// Higher priorities are consumed first, the default priority is 0.
+func WithPriority(priority int) PublishOption {
+	return func(o *publishOptions) {
+		o.priority = &priority
+	}
+}
+
+// WithDedupKey prevents publishing another task with the same key during the dedup window.
+func WithDedupKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.dedupKey = key
+	}
+}
+
+// WithDedupHash is like WithDedupKey with a key derived from the task name and arguments.
+func WithDedupHash() PublishOption {
+	return func(o *publishOptions) {
+		o.dedupHash = true
+	}
+}
+
+// WithDedupWindow sets the period during which the dedup key is effective (default to DefaultDedupWindow).
+func WithDedupWindow(window time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.dedupWindow = window
+	}
+}
+
+// WithUnique prevents having two tasks with the same name pending or running at the same time.
+// The uniqueness is enforced by a unique index of the tasks table.
+func WithUnique(mode UniqueMode) PublishOption {
+	return func(o *publishOptions) {
+		o.unique = true
+		o.uniqueMode = mode
+	}
+}
+
+// WithUniqueArgs is like WithUnique with the tasks of the same name and arguments.
+func WithUniqueArgs(mode UniqueMode) PublishOption {
+	return func(o *publishOptions) {
+		o.uniqueArgs = true
+		o.uniqueMode = mode
+	}
+}
+
+// WithOrderingKey runs the tasks sharing the given key one at a time, in publish order (FIFO).
+// The publishers of a key are serialized until their transaction commits (see PublishTx),
+// so a long transaction delays the other publishes of its key.
+// Tasks with different keys still run concurrently. A failed task blocks the next ones until
+// it succeeds or is moved to the dead letters, the priority only applies between keys.
+func WithOrderingKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.orderingKey = key
+	}
+}
+
+// WithDebounce only runs the last of the tasks published with the given key,
+// once no task of the key has been published during the window.
+// A publish while a task of the key is pending replaces the signature of the pending task, which keeps its UUID:
+// the signature's UUID of the publish is set to the UUID of the pending task.
+func WithDebounce(key string, window time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.coalesceKey = key
+		o.coalesceMode = Debounce
+		o.coalesceWindow = window
+	}
+}
+
+// WithThrottle starts at most one task published with the given key per interval, measured between the starts of the tasks.
+// A publish while a task of the key is pending is dropped, with its arguments, and recorded in the coalesced publishes:
+// its signature's UUID is set to the UUID of the pending task.
+func WithThrottle(key string, interval time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.coalesceKey = key
+		o.coalesceMode = Throttle
+		o.coalesceWindow = interval
+	}
+}
+
+// hashSignature returns a hash of the name and the arguments of the given signature
+func hashSignature(sig *signatures.TaskSignature) (string, error) {
+	args, err := json.Marshal(sig.Args)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(sig.Name))
+	h.Write([]byte{0})
+	h.Write(args)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
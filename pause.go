@@ -0,0 +1,104 @@
+package machinerypg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Pause model stops the delivery of the tasks of a queue or of a task name.
+type Pause struct {
+	CreatedAt *time.Time
+	Scope     Scope  `gorm:"primary_key"`
+	Name      string `gorm:"primary_key"`
+}
+
+// Pauses returns all the paused queues and task names
+func Pauses() ([]*Pause, error) {
+	pauses := []*Pause{}
+	if err := DB.Order("scope").Order("name").Find(&pauses).Error; err != nil {
+		return nil, fmt.Errorf("Pauses: %s", err)
+	}
+	return pauses, nil
+}
+
+// PauseQueue stops delivering the tasks of the given queue, the running ones are not interrupted
+func PauseQueue(queue string) error {
+	if err := pause(QueueScope, queue); err != nil {
+		return fmt.Errorf("PauseQueue: %s", err)
+	}
+	return nil
+}
+
+// ResumeQueue delivers again the tasks of the given queue
+func ResumeQueue(queue string) error {
+	if err := resume(QueueScope, queue); err != nil {
+		return fmt.Errorf("ResumeQueue: %s", err)
+	}
+	return nil
+}
+
+// PauseTask stops delivering the tasks of the given name, the running ones are not interrupted
+func PauseTask(name string) error {
+	if err := pause(TaskScope, name); err != nil {
+		return fmt.Errorf("PauseTask: %s", err)
+	}
+	return nil
+}
+
+// ResumeTask delivers again the tasks of the given name
+func ResumeTask(name string) error {
+	if err := resume(TaskScope, name); err != nil {
+		return fmt.Errorf("ResumeTask: %s", err)
+	}
+	return nil
+}
+
+// pause inserts the given pause, the workers skip the paused tasks from their next claim.
+// Pausing an already paused queue or task name does nothing.
+func pause(scope Scope, name string) error {
+	return DB.Exec("INSERT INTO pauses (created_at, scope, name) VALUES (now(), ?, ?) ON CONFLICT DO NOTHING", scope, name).Error
+}
+
+// resume deletes the given pause and wakes up the workers of the resumed tasks
+func resume(scope Scope, name string) error {
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Where("scope = ? AND name = ?", scope, name).Delete(&Pause{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	queues := []string{name}
+	if scope == TaskScope {
+		queues = nil
+		err := tx.Model(&Task{}).
+			Where("consumed = ?", false).
+			Where("name = ?", name).
+			Pluck("DISTINCT queue", &queues).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// The notifications are sent on commit
+	for _, queue := range queues {
+		if err := notify(tx, queue, ""); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// unpaused excludes from the given query the tasks of the paused queues and task names
+func unpaused(db *gorm.DB) *gorm.DB {
+	return db.Where("NOT EXISTS (SELECT 1 FROM pauses WHERE (pauses.scope = ? AND pauses.name = tasks.queue) OR (pauses.scope = ? AND pauses.name = tasks.name))",
+		QueueScope, TaskScope)
+}
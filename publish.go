@@ -0,0 +1,232 @@
+package machinerypg
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/jinzhu/gorm"
+)
+
+// PublishWithOptions places a new message like Publish, customized by the given options.
+// When the task is a duplicate (see WithDedupKey), nothing is published and
+// the signature's UUID is replaced by the UUID of the already published task.
+// ErrTaskNotUnique is returned as is (see WithUnique).
+func (pb *Broker) PublishWithOptions(task *signatures.TaskSignature, opts ...PublishOption) error {
+	o := newPublishOptions(opts)
+	t, err := pb.newTask(task, o)
+	if err != nil {
+		return fmt.Errorf("Publish: %s", err)
+	}
+
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("Publish: %s", tx.Error)
+	}
+
+	uuid, err := publish(tx, t, o)
+	if err == ErrTaskNotUnique {
+		tx.Rollback()
+		return err
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Publish: %s", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("Publish: %s", err)
+	}
+
+	if uuid != t.UUID {
+		task.UUID = "task_" + uuid
+	}
+	return nil
+}
+
+// PublishTx places a new message like PublishWithOptions within the given transaction (transactional outbox).
+// The task only becomes visible to the workers once the transaction is committed
+// and it is discarded if the transaction is rolled back.
+func (pb *Broker) PublishTx(tx *gorm.DB, task *signatures.TaskSignature, opts ...PublishOption) error {
+	o := newPublishOptions(opts)
+	t, err := pb.newTask(task, o)
+	if err != nil {
+		return fmt.Errorf("PublishTx: %s", err)
+	}
+
+	uuid, err := publish(tx, t, o)
+	if err == ErrTaskNotUnique {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("PublishTx: %s", err)
+	}
+
+	if uuid != t.UUID {
+		task.UUID = "task_" + uuid
+	}
+	return nil
+}
+
+// PublishSQLTx is like PublishTx with a database/sql transaction.
+func (pb *Broker) PublishSQLTx(tx *sql.Tx, task *signatures.TaskSignature, opts ...PublishOption) error {
+	db, err := gorm.Open("postgres", tx)
+	if err != nil {
+		return fmt.Errorf("PublishSQLTx: %s", err)
+	}
+
+	return pb.PublishTx(db, task, opts...)
+}
+
+// newTask builds the task of the given signature
+func (pb *Broker) newTask(sig *signatures.TaskSignature, o *publishOptions) (*Task, error) {
+	t := NewTask()
+	if err := t.ApplySignature(sig); err != nil {
+		return nil, err
+	}
+	if t.Queue == "" {
+		t.Queue = pb.defaultQueue
+	}
+	if err := o.apply(t, sig); err != nil {
+		return nil, err
+	}
+	t.State = backends.PendingState
+
+	return t, nil
+}
+
+// publish writes the given task within the given transaction and notifies the consumers on commit.
+// It returns the UUID of the published task, which differs from the given task's one for a duplicate
+// or a coalesced publish.
+func publish(tx *gorm.DB, t *Task, o *publishOptions) (string, error) {
+	if t.DedupKey != nil {
+		// Keys older than the dedup window do not prevent publishing anymore
+		err := tx.Unscoped().Model(&Task{}).
+			Where("dedup_key = ?", *t.DedupKey).
+			Where("created_at < ?", time.Now().UTC().Add(-o.dedupWindow)).
+			Update("dedup_key", nil).Error
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if t.OrderingKey != nil {
+		if err := lockKey(tx, orderingLock, *t.OrderingKey); err != nil {
+			return "", err
+		}
+	}
+
+	if t.CoalesceKey != nil {
+		uuid, err := coalesce(tx, t, o)
+		if err != nil {
+			return "", err
+		}
+		if uuid != "" {
+			// Merged into a pending task
+			return uuid, nil
+		}
+	}
+
+	// Conflicts are resolved below so the insertion is safe against concurrent publishers.
+	// The conflicting unique task may be consumed in the meantime, then the insertion is tried again.
+	for attempt := 0; ; attempt++ {
+		inserted, err := insertTask(tx, t)
+		if err != nil {
+			return "", err
+		}
+		if inserted {
+			break
+		}
+
+		if t.DedupKey != nil {
+			existing := &Task{}
+			err := tx.Unscoped().
+				Where("dedup_key = ?", *t.DedupKey).
+				First(existing).Error
+			if err == nil && existing.UUID != t.UUID {
+				// Duplicate
+				return existing.UUID, nil
+			}
+			if err != nil && err != gorm.ErrRecordNotFound {
+				return "", err
+			}
+		}
+
+		if t.UniqueKey != nil {
+			existing := &Task{}
+			err := tx.Where("unique_key = ?", *t.UniqueKey).
+				Where("consumed = ?", false).
+				First(existing).Error
+			if err == nil && existing.UUID != t.UUID {
+				if o.uniqueMode == RejectDuplicates {
+					return "", ErrTaskNotUnique
+				}
+				return existing.UUID, nil
+			}
+			if err != nil && err != gorm.ErrRecordNotFound {
+				return "", err
+			}
+		}
+
+		// The task already exists (e.g. created by Backend.InitGroup or re-published by a Machinery retry),
+		// it is delivered again and the lease of the current delivery is released
+		db := tx.Model(t).Updates(map[string]interface{}{
+			"Consumed":    t.Consumed,
+			"LockedUntil": nil,
+			"LockedBy":    "",
+			"State":       t.State,
+			"Name":        t.Name,
+			"GroupUUID":   t.GroupUUID,
+			"Queue":       t.Queue,
+			"RunAt":       t.RunAt,
+			"Priority":    t.Priority,
+			"DedupKey":    t.DedupKey,
+			"UniqueKey":   t.UniqueKey,
+			"OrderingKey": t.OrderingKey,
+			"RawTask":     t.RawTask,
+		})
+		if db.Error != nil {
+			return "", db.Error
+		}
+		if db.RowsAffected > 0 {
+			break
+		}
+		if attempt > 0 {
+			return "", fmt.Errorf("could not insert task %s: conflicting task not found", t.UUID)
+		}
+	}
+
+	// Wake up the consumers, the notification is sent on commit
+	if err := notify(tx, t.Queue, t.UUID); err != nil {
+		return "", err
+	}
+	return t.UUID, nil
+}
+
+// insertTask inserts the given task, it returns false when a conflicting task already exists
+func insertTask(tx *gorm.DB, t *Task) (bool, error) {
+	db := tx.Set("gorm:insert_option", "ON CONFLICT DO NOTHING").Create(t)
+	switch db.Error {
+	case nil:
+		return db.RowsAffected > 0, nil
+	case sql.ErrNoRows:
+		// Nothing returned by the RETURNING clause
+		return false, nil
+	default:
+		return false, db.Error
+	}
+}
+
+// Classes of the advisory locks taken by the publishers on a key
+const (
+	coalesceLock = iota + 1
+	orderingLock
+)
+
+// lockKey serializes the publishers of the given key until the end of the given transaction.
+// Ordering keys are locked so the tasks of a key get their sequence in commit order (see WithOrderingKey).
+func lockKey(tx *gorm.DB, class int, key string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", class, key).Error
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/jinzhu/gorm"
 )
 
 // ------------------------- //
@@ -17,16 +18,21 @@ var (
 )
 
 // StartCleanupRoutine deletes the succeeded tasks older than 24 hours each CleanupInterval.
+// Workers dead for more than 24 hours and control commands older than 24 hours are also removed.
 func StartCleanupRoutine() {
 	ticker := time.NewTicker(CleanupInterval)
 	quitCleanup = make(chan struct{})
 
 	deleteOldSucceededTasks()
+	deleteDeadWorkers()
+	deleteOldCommands()
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
 				deleteOldSucceededTasks()
+				deleteDeadWorkers()
+				deleteOldCommands()
 			case <-quitCleanup:
 				ticker.Stop()
 				return
@@ -48,6 +54,143 @@ func deleteOldSucceededTasks() {
 		Delete(&Task{})
 }
 
+// ------------------------- //
+// Reaper                    //
+// ------------------------- //
+
+// LostTaskPolicy defines what the reaper does with the tasks of a dead worker.
+// Whatever the policy, a lost task which reached its retry policy's MaxAttempts (MaxDeliveries without retries)
+// is moved to the dead letters.
+type LostTaskPolicy int
+
+const (
+	// RequeueLostTasks delivers the lost tasks to another worker.
+	RequeueLostTasks LostTaskPolicy = iota
+	// FailLostTasks moves the lost tasks to the dead letters.
+	FailLostTasks
+)
+
+var (
+	// ReaperInterval is the interval between two lookups of lost tasks.
+	ReaperInterval = 1 * time.Minute
+	// LostTasksPolicy is the policy applied on lost tasks.
+	LostTasksPolicy = RequeueLostTasks
+	quitReaper      chan struct{}
+)
+
+// StartReaperRoutine looks for the tasks of dead workers each ReaperInterval.
+// A task is lost when its worker stopped heartbeating its lease,
+// or when it is still RECEIVED or STARTED long after being consumed.
+func StartReaperRoutine() {
+	ticker := time.NewTicker(ReaperInterval)
+	quitReaper = make(chan struct{})
+
+	reapLostTasks()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				reapLostTasks()
+			case <-quitReaper:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// StopReaper stops reaper routine.
+func StopReaper() {
+	close(quitReaper)
+}
+
+func reapLostTasks() {
+	// Lost tasks which are not requeued are moved to the dead letters
+	n, err := deadLetterLostTasks()
+	if err != nil {
+		logg.Printf("Reaper: %s", err)
+		return
+	}
+	if n > 0 {
+		logg.Printf("Reaper: %d lost tasks moved to the dead letters", n)
+	}
+
+	// Broadcast tasks of dead workers will never be consumed
+	orphans, err := failOrphanBroadcasts()
+	if err != nil {
+		logg.Printf("Reaper: %s", err)
+		return
+	}
+	if orphans > 0 {
+		logg.Printf("Reaper: %d broadcast tasks of dead workers failed", orphans)
+	}
+
+	if _, err := finalizeBroadcasts(); err != nil {
+		logg.Printf("Reaper: %s", err)
+		return
+	}
+
+	if LostTasksPolicy != RequeueLostTasks {
+		return
+	}
+
+	// A unique task is not requeued while an equivalent one is pending or running (see WithUnique)
+	db := lostTasks(DB.Model(&Task{})).
+		Where("consumed = ? OR unique_key IS NULL OR NOT EXISTS (SELECT 1 FROM tasks t WHERE t.unique_key = tasks.unique_key AND NOT t.consumed AND t.deleted_at IS NULL)", false).
+		Updates(map[string]interface{}{
+			"consumed":     false,
+			"locked_until": nil,
+			"locked_by":    "",
+			"state":        backends.PendingState,
+		})
+	if db.Error != nil {
+		logg.Printf("Reaper: %s", db.Error)
+		return
+	}
+	if db.RowsAffected > 0 {
+		logg.Printf("Reaper: %d lost tasks requeued", db.RowsAffected)
+	}
+}
+
+// deadLetterLostTasks moves to the dead letters the lost tasks that must not be requeued
+func deadLetterLostTasks() (int, error) {
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	tasks := []*Task{}
+	if err := lostTasks(tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED")).Find(&tasks).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	n := 0
+	for _, task := range tasks {
+		if LostTasksPolicy == RequeueLostTasks && task.Attempts < maxDeliveries(task.Name) {
+			continue
+		}
+
+		if err := deadLetter(tx, task, "task lost by its worker"); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n++
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// lostTasks scopes the given query to the tasks of dead workers
+func lostTasks(db *gorm.DB) *gorm.DB {
+	return db.Where("(consumed = ? AND locked_until < now()) OR (consumed = ? AND state IN (?) AND updated_at < ?)",
+		false,
+		true, []string{backends.ReceivedState, backends.StartedState}, time.Now().UTC().Add(-LeaseDuration))
+}
+
 // ------------------------- //
 // Metrics                   //
 // ------------------------- //
@@ -72,6 +215,11 @@ func FailedTasks() Metrics {
 	return countTasks(backends.FailureState)
 }
 
+// RevokedTasks returns all metrics of revoked tasks.
+func RevokedTasks() Metrics {
+	return countTasks(RevokedState)
+}
+
 func Last20Errors() []Metrics {
 	tasks := make([]Task, 0)
 	DB.Where("state = ?", backends.FailureState).
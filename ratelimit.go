@@ -0,0 +1,129 @@
+package machinerypg
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// RateLimit model is a token bucket shared by all the workers.
+// A task of the bucket's task name or queue is only claimed when the bucket has a token.
+type RateLimit struct {
+	Scope      Scope      `gorm:"primary_key"`
+	Name       string     `gorm:"primary_key"`
+	Rate       float64    `gorm:"not null"` // Tokens added per second
+	Burst      int        `gorm:"not null"` // Capacity of the bucket
+	Tokens     float64    `gorm:"not null"`
+	RefilledAt *time.Time `gorm:"not null"`
+}
+
+// SetRateLimit limits the execution of the given task name or queue to limit tasks per period across all the workers.
+// Burst is the number of tasks that can be started at once, it defaults to limit.
+func SetRateLimit(scope Scope, name string, limit int, per time.Duration, burst int) error {
+	if limit <= 0 || per <= 0 {
+		return fmt.Errorf("SetRateLimit: invalid rate %d per %s", limit, per)
+	}
+	if burst <= 0 {
+		burst = limit
+	}
+
+	err := DB.Exec(`INSERT INTO rate_limits (scope, name, rate, burst, tokens, refilled_at) VALUES (?, ?, ?, ?, ?, now())
+		ON CONFLICT (scope, name) DO UPDATE SET rate = EXCLUDED.rate, burst = EXCLUDED.burst, tokens = LEAST(rate_limits.tokens, EXCLUDED.burst)`,
+		scope, name, bucketRate(limit, per), burst, burst).Error
+	if err != nil {
+		return fmt.Errorf("SetRateLimit: %s", err)
+	}
+	return nil
+}
+
+// RemoveRateLimit removes the rate limit of the given task name or queue.
+func RemoveRateLimit(scope Scope, name string) error {
+	if err := DB.Where("scope = ? AND name = ?", scope, name).Delete(&RateLimit{}).Error; err != nil {
+		return fmt.Errorf("RemoveRateLimit: %s", err)
+	}
+	return nil
+}
+
+// bucketRate returns the tokens added per second for limit tasks per period
+func bucketRate(limit int, per time.Duration) float64 {
+	return float64(limit) / per.Seconds()
+}
+
+// available returns the number of whole tokens of the bucket
+func (b *RateLimit) available() int {
+	if b.Tokens <= 0 {
+		return 0
+	}
+	return int(math.Floor(b.Tokens))
+}
+
+// matches returns whether the given task takes a token from the bucket
+func (b *RateLimit) matches(task *Task) bool {
+	return (b.Scope == TaskScope && b.Name == task.Name) || (b.Scope == QueueScope && b.Name == task.Queue)
+}
+
+// refillBuckets refills the buckets of the given worker and lowers the quota to their available tokens.
+// The buckets are locked until the end of the given transaction.
+func (pb *Broker) refillBuckets(tx *gorm.DB, q quota) ([]*RateLimit, error) {
+	queues, names := pb.consumed()
+	buckets := []*RateLimit{}
+	err := tx.Raw(`UPDATE rate_limits
+		SET tokens = LEAST(burst, tokens + EXTRACT(EPOCH FROM now() - refilled_at) * rate), refilled_at = now()
+		WHERE (scope = ? AND name in (?)) OR (scope = ? AND name in (?))
+		RETURNING *`,
+		TaskScope, names,
+		QueueScope, queues).
+		Scan(&buckets).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bucket := range buckets {
+		q.limit(bucket.Scope, bucket.Name, bucket.available())
+	}
+	return buckets, nil
+}
+
+// consumeTokens takes from the buckets one token per claimed task
+func consumeTokens(tx *gorm.DB, buckets []*RateLimit, tasks []*Task) error {
+	for _, bucket := range buckets {
+		n := 0
+		for _, task := range tasks {
+			if bucket.matches(task) {
+				n++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+
+		err := tx.Model(bucket).
+			Update("tokens", gorm.Expr("tokens - ?", n)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextRefill returns the duration until an empty bucket of the given worker gets a token
+func (pb *Broker) nextRefill() (time.Duration, bool) {
+	queues, names := pb.consumed()
+	var seconds *float64
+	err := DB.Model(&RateLimit{}).
+		Select("MIN((1 - tokens - EXTRACT(EPOCH FROM now() - refilled_at) * rate) / rate)").
+		Where("rate > 0").
+		Where("tokens < 1").
+		Where("(scope = ? AND name in (?)) OR (scope = ? AND name in (?))",
+			TaskScope, names,
+			QueueScope, queues).
+		Row().
+		Scan(&seconds)
+	if err != nil || seconds == nil {
+		return 0, false
+	}
+
+	return time.Duration(*seconds * float64(time.Second)), true
+}
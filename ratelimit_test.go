@@ -0,0 +1,98 @@
+package machinerypg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		per      time.Duration
+		expected float64
+	}{
+		{"per second", 10, time.Second, 10},
+		{"per minute", 30, time.Minute, 0.5},
+		{"per hour", 36, time.Hour, 0.01},
+		{"sub second", 1, 100 * time.Millisecond, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rate := bucketRate(tt.limit, tt.per); rate != tt.expected {
+				t.Errorf("bucketRate(%d, %s) = %f, expected %f", tt.limit, tt.per, rate, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRateLimitAvailable(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokens   float64
+		expected int
+	}{
+		{"empty", 0, 0},
+		{"partial token", 0.99, 0},
+		{"one token", 1, 1},
+		{"fractional tokens", 2.5, 2},
+		{"full", 10, 10},
+		{"overdrawn", -1.5, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := &RateLimit{Tokens: tt.tokens}
+			if n := bucket.available(); n != tt.expected {
+				t.Errorf("available() with %f tokens = %d, expected %d", tt.tokens, n, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRateLimitMatches(t *testing.T) {
+	task := &Task{Name: "send_email", Queue: "emails"}
+
+	tests := []struct {
+		name     string
+		bucket   *RateLimit
+		expected bool
+	}{
+		{"task name", &RateLimit{Scope: TaskScope, Name: "send_email"}, true},
+		{"other task name", &RateLimit{Scope: TaskScope, Name: "send_sms"}, false},
+		{"queue", &RateLimit{Scope: QueueScope, Name: "emails"}, true},
+		{"other queue", &RateLimit{Scope: QueueScope, Name: "sms"}, false},
+		{"queue name as task name", &RateLimit{Scope: TaskScope, Name: "emails"}, false},
+		{"task name as queue", &RateLimit{Scope: QueueScope, Name: "send_email"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := tt.bucket.matches(task); ok != tt.expected {
+				t.Errorf("matches() = %t, expected %t", ok, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetRateLimitInvalidRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		per   time.Duration
+	}{
+		{"zero limit", 0, time.Second},
+		{"negative limit", -1, time.Second},
+		{"zero period", 10, 0},
+		{"negative period", 10, -time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetRateLimit(TaskScope, "send_email", tt.limit, tt.per, 0); err == nil {
+				t.Errorf("SetRateLimit(%d, %s) succeeded, expected an error", tt.limit, tt.per)
+			}
+		})
+	}
+}
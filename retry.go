@@ -0,0 +1,89 @@
+package machinerypg
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy defines how the failed attempts of a task are retried.
+// Retries are opt-in, the zero policy does not retry.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts after which the task is moved to the dead letters.
+	// A task is not retried when it is not positive.
+	MaxAttempts int
+	// InitialInterval is the delay before the first retry.
+	InitialInterval time.Duration
+	// MaxInterval bounds the delay between two attempts.
+	MaxInterval time.Duration
+	// Multiplier is applied on the delay after each attempt, the delay is constant below 1.
+	Multiplier float64
+	// Jitter randomizes the delay by the given factor (e.g. 0.2 is ±20%).
+	Jitter float64
+}
+
+var (
+	// DefaultRetryPolicy is used by the tasks without a policy of their own.
+	// It does not retry, failed tasks are moved to the dead letters right away.
+	DefaultRetryPolicy = RetryPolicy{}
+	// MaxDeliveries is the number of deliveries after which a lost task is moved to the dead letters
+	// when its retry policy does not retry.
+	MaxDeliveries = 5
+
+	retryPolicies   = map[string]RetryPolicy{}
+	retryPoliciesMu sync.RWMutex
+)
+
+// SetRetryPolicy sets the retry policy of the given task name.
+func SetRetryPolicy(taskName string, policy RetryPolicy) {
+	retryPoliciesMu.Lock()
+	defer retryPoliciesMu.Unlock()
+
+	retryPolicies[taskName] = policy
+}
+
+// retryPolicy returns the retry policy of the given task name
+func retryPolicy(taskName string) RetryPolicy {
+	retryPoliciesMu.RLock()
+	defer retryPoliciesMu.RUnlock()
+
+	if policy, ok := retryPolicies[taskName]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
+
+// maxDeliveries returns the number of deliveries after which a lost task of the given name is moved to the dead letters
+func maxDeliveries(taskName string) int {
+	if policy := retryPolicy(taskName); policy.MaxAttempts > 0 {
+		return policy.MaxAttempts
+	}
+	return MaxDeliveries
+}
+
+// Exhausted returns true when no more attempts are allowed after the given number of attempts.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return attempts >= p.MaxAttempts
+}
+
+// Backoff returns the delay before the next attempt after the given number of attempts.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialInterval) * math.Pow(multiplier, float64(attempts-1))
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if p.MaxInterval > 0 && delay > float64(p.MaxInterval) {
+		delay = float64(p.MaxInterval)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,204 @@
+package machinerypg
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:     5,
+		InitialInterval: 10 * time.Second,
+		MaxInterval:     time.Minute,
+		Multiplier:      2,
+	}
+
+	tests := []struct {
+		name     string
+		attempts int
+		expected time.Duration
+	}{
+		{"no attempt", 0, 10 * time.Second},
+		{"first attempt", 1, 10 * time.Second},
+		{"second attempt", 2, 20 * time.Second},
+		{"third attempt", 3, 40 * time.Second},
+		{"capped", 4, time.Minute},
+		{"still capped", 10, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := policy.Backoff(tt.attempts); d != tt.expected {
+				t.Errorf("Backoff(%d) = %s, expected %s", tt.attempts, d, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoffUncapped(t *testing.T) {
+	policy := RetryPolicy{InitialInterval: time.Second, Multiplier: 3}
+
+	if d := policy.Backoff(5); d != 81*time.Second {
+		t.Errorf("Backoff(5) = %s, expected %s", d, 81*time.Second)
+	}
+}
+
+func TestRetryPolicyBackoffMultiplier(t *testing.T) {
+	tests := []struct {
+		name       string
+		initial    time.Duration
+		multiplier float64
+		expected   time.Duration
+	}{
+		{"unset", time.Minute, 0, time.Minute},
+		{"negative", time.Minute, -2, time.Minute},
+		{"below one", time.Minute, 0.5, time.Minute},
+		{"one", time.Minute, 1, time.Minute},
+		{"above one", 10 * time.Second, 1.5, 33750 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := RetryPolicy{MaxAttempts: 10, InitialInterval: tt.initial, Multiplier: tt.multiplier}
+			if d := policy.Backoff(4); d != tt.expected {
+				t.Errorf("Backoff(4) = %s, expected %s", d, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		min, max time.Duration
+	}{
+		{"first attempt", 1, 8 * time.Second, 12 * time.Second},
+		{"second attempt", 2, 16 * time.Second, 24 * time.Second},
+		{"jitter bounded by the cap", 3, 32 * time.Second, time.Minute},
+		{"jitter below the cap", 10, 48 * time.Second, time.Minute},
+	}
+
+	policy := RetryPolicy{
+		InitialInterval: 10 * time.Second,
+		MaxInterval:     time.Minute,
+		Multiplier:      2,
+		Jitter:          0.2,
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				if d := policy.Backoff(tt.attempts); d < tt.min || d > tt.max {
+					t.Fatalf("Backoff(%d) = %s, expected between %s and %s", tt.attempts, d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int
+		expected bool
+	}{
+		{"no attempt", RetryPolicy{MaxAttempts: 3}, 0, false},
+		{"attempts left", RetryPolicy{MaxAttempts: 3}, 2, false},
+		{"last attempt", RetryPolicy{MaxAttempts: 3}, 3, true},
+		{"over", RetryPolicy{MaxAttempts: 3}, 4, true},
+		{"zero policy", RetryPolicy{}, 1, true},
+		{"default policy", DefaultRetryPolicy, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if exhausted := tt.policy.Exhausted(tt.attempts); exhausted != tt.expected {
+				t.Errorf("Exhausted(%d) = %t, expected %t", tt.attempts, exhausted, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetriable(t *testing.T) {
+	task := func(state string, sig *signatures.TaskSignature) *Task {
+		raw, err := json.Marshal(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Task{State: state, RawTask: raw}
+	}
+
+	tests := []struct {
+		name     string
+		claimed  *Task
+		current  *Task
+		expected bool
+	}{
+		{
+			name:     "started",
+			claimed:  task(backends.ReceivedState, &signatures.TaskSignature{Name: "send_email"}),
+			current:  task(backends.StartedState, &signatures.TaskSignature{Name: "send_email"}),
+			expected: true,
+		},
+		{
+			name:     "failure stored",
+			claimed:  task(backends.ReceivedState, &signatures.TaskSignature{Name: "send_email"}),
+			current:  task(backends.FailureState, &signatures.TaskSignature{Name: "send_email"}),
+			expected: false,
+		},
+		{
+			name:     "success stored",
+			claimed:  task(backends.ReceivedState, &signatures.TaskSignature{Name: "send_email"}),
+			current:  task(backends.SuccessState, &signatures.TaskSignature{Name: "send_email"}),
+			expected: false,
+		},
+		{
+			name:     "retried by Machinery",
+			claimed:  task(backends.ReceivedState, &signatures.TaskSignature{Name: "send_email", RetryCount: 3}),
+			current:  task(backends.StartedState, &signatures.TaskSignature{Name: "send_email", RetryCount: 2}),
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := retriable(tt.claimed, tt.current); ok != tt.expected {
+				t.Errorf("retriable() = %t, expected %t", ok, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMaxDeliveries(t *testing.T) {
+	SetRetryPolicy("send_email", RetryPolicy{MaxAttempts: 3})
+	SetRetryPolicy("send_sms", RetryPolicy{})
+	defer func() {
+		retryPoliciesMu.Lock()
+		delete(retryPolicies, "send_email")
+		delete(retryPolicies, "send_sms")
+		retryPoliciesMu.Unlock()
+	}()
+
+	tests := []struct {
+		name     string
+		taskName string
+		expected int
+	}{
+		{"retry policy", "send_email", 3},
+		{"no retries", "send_sms", MaxDeliveries},
+		{"default policy", "resize", MaxDeliveries},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := maxDeliveries(tt.taskName); n != tt.expected {
+				t.Errorf("maxDeliveries(%s) = %d, expected %d", tt.taskName, n, tt.expected)
+			}
+		})
+	}
+}
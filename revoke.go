@@ -0,0 +1,137 @@
+package machinerypg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/jinzhu/gorm"
+)
+
+// RevokedState is the state of a revoked task.
+// It is reported as a FAILURE with the "task revoked" error to Machinery.
+const RevokedState = "REVOKED"
+
+// errRevoked is the error of a revoked task
+const errRevoked = "task revoked"
+
+// Revoke cancels the given task. A pending task is never delivered and
+// the worker running the task cancels its context (see Broker.TaskContext).
+func Revoke(taskUUID string) error {
+	err := revoke(func(db *gorm.DB) *gorm.DB {
+		// Including the per worker tasks of a broadcast task
+		return db.Where("uuid = ? OR parent_uuid = ?", UUID(taskUUID), UUID(taskUUID))
+	})
+	if err != nil {
+		return fmt.Errorf("Revoke: %s", err)
+	}
+	return nil
+}
+
+// RevokeGroup cancels all the unfinished tasks of the given group (see Revoke)
+func RevokeGroup(groupUUID string) error {
+	err := revoke(func(db *gorm.DB) *gorm.DB {
+		return db.Where("group_uuid = ? OR parent_uuid IN (SELECT uuid FROM tasks WHERE group_uuid = ?)", GUUID(groupUUID), GUUID(groupUUID))
+	})
+	if err != nil {
+		return fmt.Errorf("RevokeGroup: %s", err)
+	}
+	return nil
+}
+
+// revoke marks the unfinished tasks of the given scope as revoked and notifies their workers on commit
+func revoke(scope func(db *gorm.DB) *gorm.DB) error {
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	tasks := []*Task{}
+	err := scope(tx.Set("gorm:query_option", "FOR UPDATE")).
+		Where("state NOT IN (?)", []string{backends.SuccessState, backends.FailureState, RevokedState}).
+		Find(&tasks).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, task := range tasks {
+		// Releasing the lease makes the acknowledgement of a running task a no-op
+		err := tx.Model(task).Updates(map[string]interface{}{
+			"consumed":     true,
+			"locked_until": nil,
+			"locked_by":    "",
+			"state":        RevokedState,
+			"error":        errRevoked,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if task.LockedBy != "" {
+			if err := notifyRevocation(tx, task.UUID); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// TaskContext returns the context of the given task processed by this broker, it is cancelled when the task is revoked.
+// The task needs to know its UUID, e.g. given as an argument of its signature.
+// A background context is returned for a task which is not processed by this broker.
+func (pb *Broker) TaskContext(taskUUID string) context.Context {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if tc, ok := pb.contexts[UUID(taskUUID)]; ok {
+		return tc.ctx
+	}
+	return context.Background()
+}
+
+// taskContext is the cancellable context of an in-flight task.
+type taskContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newTaskContext() *taskContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &taskContext{ctx: ctx, cancel: cancel}
+}
+
+// revoked returns true when the given in-flight task has been revoked
+func (pb *Broker) revoked(taskUUID string) bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	tc, ok := pb.contexts[taskUUID]
+	return ok && tc.ctx.Err() != nil
+}
+
+// forget removes the given task from the in-flight tasks
+func (pb *Broker) forget(taskUUID string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if tc, ok := pb.contexts[taskUUID]; ok {
+		tc.cancel()
+	}
+	delete(pb.contexts, taskUUID)
+	delete(pb.inFlight, taskUUID)
+}
+
+// cancelTask cancels the context of the given in-flight task
+func (pb *Broker) cancelTask(taskUUID string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if tc, ok := pb.contexts[taskUUID]; ok {
+		logg.Printf("Revoked message: %s", taskUUID)
+		tc.cancel()
+	}
+}
@@ -0,0 +1,267 @@
+package machinerypg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+var (
+	// SchedulerLockKey is the Postgres advisory lock held by the leader scheduler.
+	SchedulerLockKey int64 = 0x4d50475343484544 // MPGSCHED
+	// SchedulerInterval is the maximum interval between two checks of the due schedules.
+	// It is also the interval at which a standby scheduler tries to become the leader.
+	SchedulerInterval = 15 * time.Second
+	// MisfireThreshold is the delay after which a run is considered as missed (see SkipMissedRuns).
+	MisfireThreshold = 1 * time.Minute
+	// MaxMissedRuns is the maximum number of runs fired at once by the RunAllMissed policy, the oldest ones are dropped.
+	// Zero disables the limit.
+	MaxMissedRuns = 100
+)
+
+// Scheduler publishes the recurring tasks of the schedules table.
+// Several schedulers can run in the cluster, only the one holding the advisory lock (the leader) fires the tasks.
+// Changes of the schedules are picked up through Postgres LISTEN/NOTIFY.
+type Scheduler struct {
+	broker  *Broker
+	conn    *sql.Conn
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running bool
+}
+
+// NewScheduler creates a scheduler publishing through the given broker
+func NewScheduler(broker *Broker) *Scheduler {
+	return &Scheduler{
+		broker: broker,
+	}
+}
+
+// Add creates or replaces a schedule defined in the code. Spec is a standard cron expression or "@every <duration>".
+// The enabled flag and the last run of an existing schedule are kept.
+func (s *Scheduler) Add(name, spec string, sig *signatures.TaskSignature, catchUp CatchUpPolicy) error {
+	schedule, err := NewSchedule(name, spec, sig)
+	if err != nil {
+		return fmt.Errorf("Add: %s", err)
+	}
+
+	err = updateSchedules(func(tx *gorm.DB) error {
+		return tx.Exec(`INSERT INTO schedules (created_at, updated_at, name, spec, timezone, raw_task, catch_up, enabled) VALUES (now(), now(), ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET updated_at = now(), spec = EXCLUDED.spec, raw_task = EXCLUDED.raw_task, catch_up = EXCLUDED.catch_up, next_run_at = NULL`,
+			schedule.Name, schedule.Spec, schedule.Timezone, schedule.RawTask, catchUp, schedule.Enabled).Error
+	})
+	if err != nil {
+		return fmt.Errorf("Add: %s", err)
+	}
+	return nil
+}
+
+// Start runs the scheduler in the background
+func (s *Scheduler) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return nil
+	}
+
+	listener, err := newListener(s.broker.url, schedulesChannel)
+	if err != nil {
+		return fmt.Errorf("Start: %s", err)
+	}
+
+	s.running = true
+	s.quit = make(chan struct{})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer listener.Close()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for {
+			delay := SchedulerInterval
+			if s.elect() {
+				s.fireDueSchedules()
+				if d, ok := nextScheduleDelay(); ok && d < delay {
+					delay = d
+				}
+			}
+			resetTimer(timer, delay)
+
+			select {
+			case <-listener.Notify:
+			case <-timer.C:
+			case <-s.quit:
+				s.resign()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the scheduler and releases the leadership
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	close(s.quit)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// IsLeader returns true when this scheduler fires the tasks of the cluster
+func (s *Scheduler) IsLeader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn != nil
+}
+
+// elect tries to become the leader, it returns true if this scheduler is the leader.
+// The advisory lock lives with the dedicated connection, the leadership is lost with the connection.
+func (s *Scheduler) elect() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx := context.Background()
+	if s.conn != nil {
+		if err := s.conn.PingContext(ctx); err == nil {
+			return true
+		}
+		logg.Printf("Scheduler: leadership lost")
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	conn, err := DB.DB().Conn(ctx)
+	if err != nil {
+		logg.Printf("Scheduler: %s", err)
+		return false
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", SchedulerLockKey).Scan(&locked); err != nil || !locked {
+		conn.Close()
+		return false
+	}
+
+	logg.Printf("Scheduler: elected as leader")
+	s.conn = conn
+	return true
+}
+
+// resign releases the leadership
+func (s *Scheduler) resign() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+	s.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", SchedulerLockKey)
+	s.conn.Close()
+	s.conn = nil
+}
+
+// fireDueSchedules publishes the tasks of the due schedules
+func (s *Scheduler) fireDueSchedules() {
+	var names []string
+	err := DB.Model(&Schedule{}).
+		Where("enabled = ?", true).
+		Where("next_run_at IS NULL OR next_run_at <= now()").
+		Pluck("name", &names).Error
+	if err != nil {
+		logg.Printf("Scheduler: %s", err)
+		return
+	}
+
+	for _, name := range names {
+		if err := s.fire(name); err != nil {
+			logg.Printf("Scheduler: %s: %s", name, err)
+		}
+	}
+}
+
+// fire publishes the due runs of the given schedule, along with its new last run, in a single transaction
+func (s *Scheduler) fire(name string) error {
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	schedule := &Schedule{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("name = ?", name).
+		Where("enabled = ?", true).
+		First(schedule).Error
+	if err == gorm.ErrRecordNotFound {
+		// Paused or deleted in the meantime
+		tx.Rollback()
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	runs, latest, next, err := schedule.dueRuns(time.Now().UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, run := range runs {
+		sig, err := schedule.Signature()
+		if err == nil {
+			err = s.broker.PublishTx(tx, sig)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("run of %s: %s", run, err)
+		}
+	}
+
+	updates := map[string]interface{}{"next_run_at": next}
+	if latest != nil {
+		updates["last_run_at"] = *latest
+	}
+	if err := tx.Model(schedule).Updates(updates).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// nextScheduleDelay returns the duration until the next run of the enabled schedules
+func nextScheduleDelay() (time.Duration, bool) {
+	var runAt pq.NullTime
+	err := DB.Model(&Schedule{}).
+		Select("MIN(next_run_at)").
+		Where("enabled = ?", true).
+		Row().
+		Scan(&runAt)
+	if err != nil || !runAt.Valid {
+		return 0, false
+	}
+
+	delay := runAt.Time.Sub(time.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
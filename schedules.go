@@ -0,0 +1,298 @@
+package machinerypg
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/jinzhu/gorm"
+	"github.com/robfig/cron"
+)
+
+// CatchUpPolicy defines what the scheduler does with the runs missed during a downtime.
+type CatchUpPolicy string
+
+const (
+	// SkipMissedRuns drops the missed runs and waits for the next one.
+	SkipMissedRuns CatchUpPolicy = "skip"
+	// RunOnce fires a single run for all the missed ones.
+	RunOnce CatchUpPolicy = "once"
+	// RunAllMissed fires every missed run, up to the latest MaxMissedRuns ones.
+	RunAllMissed CatchUpPolicy = "all"
+)
+
+// Schedule model represents a recurring task.
+type Schedule struct {
+	CreatedAt *time.Time
+	UpdatedAt *time.Time
+
+	Name      string        `gorm:"primary_key"`
+	Spec      string        `gorm:"not null"`                    // Cron expression or "@every <duration>"
+	Timezone  string        `gorm:"not null;default:'UTC'"`      // IANA time zone of the cron expression
+	RawTask   []byte        `gorm:"type:jsonb"`                  // Signature template
+	CatchUp   CatchUpPolicy `gorm:"not null;default:'skip'"`     // See CatchUpPolicy
+	Enabled   bool          `gorm:"index;not null;default:true"` // See PauseSchedule
+	LastRunAt *time.Time
+	NextRunAt *time.Time `gorm:"index"`
+}
+
+// NewSchedule returns an enabled schedule of the given signature
+func NewSchedule(name, spec string, sig *signatures.TaskSignature) (*Schedule, error) {
+	s := &Schedule{
+		Name:     name,
+		Spec:     spec,
+		Timezone: "UTC",
+		CatchUp:  SkipMissedRuns,
+		Enabled:  true,
+	}
+	if err := s.SetSignature(sig); err != nil {
+		return nil, fmt.Errorf("NewSchedule: %s", err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("NewSchedule: %s", err)
+	}
+	return s, nil
+}
+
+// SetSignature sets the signature template of the schedule
+func (s *Schedule) SetSignature(sig *signatures.TaskSignature) error {
+	raw, err := json.Marshal(sig)
+	if err != nil {
+		return fmt.Errorf("SetSignature: %s", err)
+	}
+	s.RawTask = raw
+	return nil
+}
+
+// Signature returns a new signature from the template of the schedule
+func (s *Schedule) Signature() (*signatures.TaskSignature, error) {
+	task := &signatures.TaskSignature{}
+	if err := json.Unmarshal(s.RawTask, task); err != nil {
+		return nil, fmt.Errorf("Signature: %s", err)
+	}
+	task.UUID = "task_" + NewUUID()
+	return task, nil
+}
+
+// validate checks the spec and the time zone of the schedule
+func (s *Schedule) validate() error {
+	schedule, err := cron.ParseStandard(s.Spec)
+	if err != nil {
+		return err
+	}
+	loc, err := s.location()
+	if err != nil {
+		return err
+	}
+	// A valid spec can match no date (e.g. February 30th)
+	if schedule.Next(time.Now().In(loc)).IsZero() {
+		return fmt.Errorf("spec %q never fires", s.Spec)
+	}
+	return nil
+}
+
+// location returns the time zone of the schedule
+func (s *Schedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+// dueRuns returns the runs to fire at the given time according to the catch-up policy,
+// the latest elapsed run (nil when none elapsed) and the next run.
+func (s *Schedule) dueRuns(now time.Time) ([]time.Time, *time.Time, time.Time, error) {
+	schedule, err := cron.ParseStandard(s.Spec)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	loc, err := s.location()
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	last := now
+	if s.LastRunAt != nil {
+		last = *s.LastRunAt
+	} else if s.CreatedAt != nil {
+		last = *s.CreatedAt
+	}
+
+	// Cron fields are matched in the time zone of the given time.
+	// Only the latest MaxMissedRuns elapsed runs are kept.
+	var elapsed []time.Time
+	next := schedule.Next(last.In(loc))
+	for ; !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+		if MaxMissedRuns > 0 && len(elapsed) >= MaxMissedRuns {
+			elapsed = elapsed[1:]
+		}
+		elapsed = append(elapsed, next.UTC())
+	}
+	if next.IsZero() {
+		return nil, nil, time.Time{}, fmt.Errorf("spec %q never fires", s.Spec)
+	}
+	next = next.UTC()
+	if len(elapsed) == 0 {
+		return nil, nil, next, nil
+	}
+
+	latest := elapsed[len(elapsed)-1]
+	switch s.CatchUp {
+	case RunAllMissed:
+		return elapsed, &latest, next, nil
+	case RunOnce:
+		return []time.Time{latest}, &latest, next, nil
+	default:
+		if now.Sub(latest) < MisfireThreshold {
+			return []time.Time{latest}, &latest, next, nil
+		}
+		// Missed runs are skipped
+		return nil, &latest, next, nil
+	}
+}
+
+// ------------------------- //
+// API                       //
+// ------------------------- //
+
+// Schedules returns all the schedules ordered by name
+func Schedules() ([]*Schedule, error) {
+	schedules := []*Schedule{}
+	if err := DB.Order("name").Find(&schedules).Error; err != nil {
+		return nil, fmt.Errorf("Schedules: %s", err)
+	}
+	return schedules, nil
+}
+
+// GetSchedule returns the schedule of the given name
+func GetSchedule(name string) (*Schedule, error) {
+	s := &Schedule{}
+	if err := DB.Where("name = ?", name).First(s).Error; err != nil {
+		return nil, fmt.Errorf("GetSchedule: %s", err)
+	}
+	return s, nil
+}
+
+// CreateSchedule creates the given schedule, its first run is computed from now.
+// The schedule is created enabled, use PauseSchedule to disable it.
+func CreateSchedule(s *Schedule) error {
+	if err := s.validate(); err != nil {
+		return fmt.Errorf("CreateSchedule: %s", err)
+	}
+
+	s.Enabled = true
+	s.LastRunAt = nil
+	s.NextRunAt = nil
+	err := updateSchedules(func(tx *gorm.DB) error {
+		return tx.Create(s).Error
+	})
+	if err != nil {
+		return fmt.Errorf("CreateSchedule: %s", err)
+	}
+	return nil
+}
+
+// UpdateSchedule saves the spec, time zone, signature template, catch-up policy and enabled flag of the given schedule.
+// When the spec or the time zone changes, the runs are computed from now.
+func UpdateSchedule(s *Schedule) error {
+	if err := s.validate(); err != nil {
+		return fmt.Errorf("UpdateSchedule: %s", err)
+	}
+
+	err := updateSchedules(func(tx *gorm.DB) error {
+		current := &Schedule{}
+		err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("name = ?", s.Name).
+			First(current).Error
+		if err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{
+			"spec":        s.Spec,
+			"timezone":    s.Timezone,
+			"raw_task":    s.RawTask,
+			"catch_up":    s.CatchUp,
+			"enabled":     s.Enabled,
+			"next_run_at": nil,
+		}
+		if current.Spec != s.Spec || current.Timezone != s.Timezone || !current.Enabled && s.Enabled {
+			updates["last_run_at"] = time.Now().UTC()
+		}
+		return tx.Model(current).Updates(updates).Error
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateSchedule: %s", err)
+	}
+	return nil
+}
+
+// PauseSchedule stops firing the given schedule
+func PauseSchedule(name string) error {
+	err := setScheduleEnabled(name, map[string]interface{}{
+		"enabled": false,
+	})
+	if err != nil {
+		return fmt.Errorf("PauseSchedule: %s", err)
+	}
+	return nil
+}
+
+// ResumeSchedule fires again the given schedule, the runs missed while paused are skipped
+func ResumeSchedule(name string) error {
+	err := setScheduleEnabled(name, map[string]interface{}{
+		"enabled":     true,
+		"last_run_at": time.Now().UTC(),
+		"next_run_at": nil,
+	})
+	if err != nil {
+		return fmt.Errorf("ResumeSchedule: %s", err)
+	}
+	return nil
+}
+
+// DeleteSchedule deletes the given schedule, the already published tasks are kept
+func DeleteSchedule(name string) error {
+	err := updateSchedules(func(tx *gorm.DB) error {
+		db := tx.Where("name = ?", name).Delete(&Schedule{})
+		if db.Error == nil && db.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return db.Error
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteSchedule: %s", err)
+	}
+	return nil
+}
+
+func setScheduleEnabled(name string, updates map[string]interface{}) error {
+	return updateSchedules(func(tx *gorm.DB) error {
+		db := tx.Model(&Schedule{}).Where("name = ?", name).Updates(updates)
+		if db.Error == nil && db.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return db.Error
+	})
+}
+
+// updateSchedules runs the given changes in a transaction and notifies the schedulers on commit
+func updateSchedules(fn func(tx *gorm.DB) error) error {
+	tx := DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := notifySchedulers(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
@@ -0,0 +1,196 @@
+package machinerypg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleDueRuns(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	ptr := func(s string) *time.Time {
+		tm := at(s)
+		return &tm
+	}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		runs     []time.Time
+		latest   *time.Time
+		next     time.Time
+	}{
+		{
+			name:     "not due since creation",
+			schedule: Schedule{Spec: "*/10 * * * *", CreatedAt: ptr("2026-01-10T12:01:00Z")},
+			now:      at("2026-01-10T12:05:00Z"),
+			next:     at("2026-01-10T12:10:00Z"),
+		},
+		{
+			name:     "due run",
+			schedule: Schedule{Spec: "*/10 * * * *", LastRunAt: ptr("2026-01-10T12:00:00Z")},
+			now:      at("2026-01-10T12:10:30Z"),
+			runs:     []time.Time{at("2026-01-10T12:10:00Z")},
+			latest:   ptr("2026-01-10T12:10:00Z"),
+			next:     at("2026-01-10T12:20:00Z"),
+		},
+		{
+			name:     "missed runs skipped",
+			schedule: Schedule{Spec: "*/10 * * * *", CatchUp: SkipMissedRuns, LastRunAt: ptr("2026-01-10T12:00:00Z")},
+			now:      at("2026-01-10T12:45:00Z"),
+			latest:   ptr("2026-01-10T12:40:00Z"),
+			next:     at("2026-01-10T12:50:00Z"),
+		},
+		{
+			name:     "missed runs run once",
+			schedule: Schedule{Spec: "*/10 * * * *", CatchUp: RunOnce, LastRunAt: ptr("2026-01-10T12:00:00Z")},
+			now:      at("2026-01-10T12:45:00Z"),
+			runs:     []time.Time{at("2026-01-10T12:40:00Z")},
+			latest:   ptr("2026-01-10T12:40:00Z"),
+			next:     at("2026-01-10T12:50:00Z"),
+		},
+		{
+			name:     "all missed runs",
+			schedule: Schedule{Spec: "*/10 * * * *", CatchUp: RunAllMissed, LastRunAt: ptr("2026-01-10T12:00:00Z")},
+			now:      at("2026-01-10T12:45:00Z"),
+			runs: []time.Time{
+				at("2026-01-10T12:10:00Z"),
+				at("2026-01-10T12:20:00Z"),
+				at("2026-01-10T12:30:00Z"),
+				at("2026-01-10T12:40:00Z"),
+			},
+			latest: ptr("2026-01-10T12:40:00Z"),
+			next:   at("2026-01-10T12:50:00Z"),
+		},
+		{
+			name:     "every duration",
+			schedule: Schedule{Spec: "@every 1h", CatchUp: RunAllMissed, LastRunAt: ptr("2026-01-10T10:00:00Z")},
+			now:      at("2026-01-10T12:30:00Z"),
+			runs:     []time.Time{at("2026-01-10T11:00:00Z"), at("2026-01-10T12:00:00Z")},
+			latest:   ptr("2026-01-10T12:00:00Z"),
+			next:     at("2026-01-10T13:00:00Z"),
+		},
+		{
+			name:     "time zone in winter",
+			schedule: Schedule{Spec: "0 9 * * *", Timezone: "Europe/Paris", CatchUp: RunAllMissed, LastRunAt: ptr("2026-01-10T00:00:00Z")},
+			now:      at("2026-01-10T08:30:00Z"),
+			runs:     []time.Time{at("2026-01-10T08:00:00Z")},
+			latest:   ptr("2026-01-10T08:00:00Z"),
+			next:     at("2026-01-11T08:00:00Z"),
+		},
+		{
+			name:     "time zone in summer",
+			schedule: Schedule{Spec: "0 9 * * *", Timezone: "Europe/Paris", CatchUp: RunAllMissed, LastRunAt: ptr("2026-07-10T00:00:00Z")},
+			now:      at("2026-07-10T08:30:00Z"),
+			runs:     []time.Time{at("2026-07-10T07:00:00Z")},
+			latest:   ptr("2026-07-10T07:00:00Z"),
+			next:     at("2026-07-11T07:00:00Z"),
+		},
+		{
+			name:     "time zone behind UTC",
+			schedule: Schedule{Spec: "0 9 * * *", Timezone: "America/New_York", LastRunAt: ptr("2026-01-10T00:00:00Z")},
+			now:      at("2026-01-10T12:00:00Z"),
+			next:     at("2026-01-10T14:00:00Z"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs, latest, next, err := tt.schedule.dueRuns(tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(runs, tt.runs) {
+				t.Errorf("runs = %v, expected %v", runs, tt.runs)
+			}
+			if (latest == nil) != (tt.latest == nil) || latest != nil && !latest.Equal(*tt.latest) {
+				t.Errorf("latest = %v, expected %v", latest, tt.latest)
+			}
+			if !next.Equal(tt.next) {
+				t.Errorf("next = %s, expected %s", next, tt.next)
+			}
+		})
+	}
+}
+
+func TestScheduleDueRunsNeverFires(t *testing.T) {
+	last := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	schedule := Schedule{Spec: "0 0 30 2 *", CatchUp: RunAllMissed, LastRunAt: &last}
+
+	if _, _, _, err := schedule.dueRuns(last.Add(time.Hour)); err == nil {
+		t.Error("dueRuns() succeeded, expected an error")
+	}
+}
+
+func TestScheduleDueRunsMaxMissedRuns(t *testing.T) {
+	last := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	now := last.Add(24 * time.Hour)
+
+	tests := []struct {
+		name     string
+		max      int
+		expected int
+	}{
+		{"capped", 100, 100},
+		{"other cap", 3, 3},
+		{"unlimited", 0, 86400},
+	}
+
+	defer func(max int) { MaxMissedRuns = max }(MaxMissedRuns)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxMissedRuns = tt.max
+			schedule := Schedule{Spec: "@every 1s", CatchUp: RunAllMissed, LastRunAt: &last}
+
+			runs, latest, next, err := schedule.dueRuns(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(runs) != tt.expected {
+				t.Fatalf("len(runs) = %d, expected %d", len(runs), tt.expected)
+			}
+			// The latest runs are kept
+			if !runs[len(runs)-1].Equal(now) || !latest.Equal(now) {
+				t.Errorf("latest = %s, expected %s", runs[len(runs)-1], now)
+			}
+			if first := now.Add(-time.Duration(tt.expected-1) * time.Second); !runs[0].Equal(first) {
+				t.Errorf("first run = %s, expected %s", runs[0], first)
+			}
+			if !next.Equal(now.Add(time.Second)) {
+				t.Errorf("next = %s, expected %s", next, now.Add(time.Second))
+			}
+		})
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		valid    bool
+	}{
+		{"cron expression", Schedule{Spec: "0 9 * * 1-5"}, true},
+		{"every duration", Schedule{Spec: "@every 90s"}, true},
+		{"time zone", Schedule{Spec: "@daily", Timezone: "Europe/Paris"}, true},
+		{"invalid spec", Schedule{Spec: "every day"}, false},
+		{"invalid time zone", Schedule{Spec: "@daily", Timezone: "Mars/Olympus"}, false},
+		{"never fires", Schedule{Spec: "0 0 30 2 *"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedule.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, expected valid %t", err, tt.valid)
+			}
+		})
+	}
+}
@@ -8,7 +8,25 @@ func MigrateBroker(url string) error {
 		return fmt.Errorf("MigrateBroker: %s", err.Error())
 	}
 
-	db := DB.AutoMigrate(&Task{})
+	// Publish order of the tasks (see WithOrderingKey)
+	db := DB.Exec("CREATE SEQUENCE IF NOT EXISTS tasks_seq")
+	if db.Error != nil {
+		return fmt.Errorf("MigrateBroker: %s", db.Error)
+	}
+
+	db = DB.AutoMigrate(&Task{}, &DeadLetter{}, &ConcurrencyLimit{}, &RateLimit{}, &Schedule{}, &Pause{}, &Worker{}, &Command{}, &CommandAck{}, &CoalescedPublish{})
+	if db.Error != nil {
+		return fmt.Errorf("MigrateBroker: %s", db.Error)
+	}
+
+	// Tasks published before queues are consumed from the default queue
+	db = DB.Exec("UPDATE tasks SET queue = '' WHERE queue IS NULL")
+	if db.Error != nil {
+		return fmt.Errorf("MigrateBroker: %s", db.Error)
+	}
+
+	// Unique tasks, only one task per key can be pending or running (see WithUnique)
+	db = DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + uniqueKeyIndex + " ON tasks (unique_key) WHERE NOT consumed AND deleted_at IS NULL")
 	if db.Error != nil {
 		return fmt.Errorf("MigrateBroker: %s", db.Error)
 	}
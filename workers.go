@@ -0,0 +1,115 @@
+package machinerypg
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// WorkerTimeout is the time after the last heartbeat from which a worker is considered as dead.
+var WorkerTimeout = 3 * HeartbeatInterval
+
+// Worker model represents a consuming broker, registered by StartConsuming.
+type Worker struct {
+	ID               string         `gorm:"primary_key"` // consumerTag@hostname:pid
+	ConsumerTag      string         `gorm:"not null"`
+	Hostname         string         `gorm:"not null"`
+	PID              int            `gorm:"not null"`
+	Queues           pq.StringArray `gorm:"type:text[]"`
+	TaskNames        pq.StringArray `gorm:"type:text[]"`
+	MaxParallelTasks int            `gorm:"not null"`
+	StartedAt        *time.Time
+	HeartbeatAt      *time.Time `gorm:"index"`
+}
+
+// Alive returns true when the worker has sent a heartbeat within WorkerTimeout.
+// The heartbeat is compared with the database clock, which writes it.
+func (w *Worker) Alive() bool {
+	if w.HeartbeatAt == nil {
+		return false
+	}
+
+	var alive bool
+	if err := DB.Raw("SELECT ? > ?", w.HeartbeatAt, heartbeatDeadline()).Row().Scan(&alive); err != nil {
+		return false
+	}
+	return alive
+}
+
+// Workers returns the registered workers, alive or dead, ordered by start time
+func Workers() ([]*Worker, error) {
+	workers := []*Worker{}
+	if err := DB.Order("started_at").Find(&workers).Error; err != nil {
+		return nil, fmt.Errorf("Workers: %s", err)
+	}
+	return workers, nil
+}
+
+// LiveWorkers returns the workers which have sent a heartbeat within WorkerTimeout
+func LiveWorkers() ([]*Worker, error) {
+	workers := []*Worker{}
+	err := DB.Where("heartbeat_at > ?", heartbeatDeadline()).
+		Order("started_at").
+		Find(&workers).Error
+	if err != nil {
+		return nil, fmt.Errorf("LiveWorkers: %s", err)
+	}
+	return workers, nil
+}
+
+// register records this broker in the workers table, or refreshes its heartbeat and settings
+func (pb *Broker) register(consumerTag string) error {
+	queues, names := pb.consumed()
+	hostname, _ := os.Hostname()
+
+	pb.mu.Lock()
+	maxParallelTasks := pb.maxParallelTasks
+	pb.mu.Unlock()
+
+	return DB.Exec(`INSERT INTO workers (id, consumer_tag, hostname, pid, queues, task_names, max_parallel_tasks, started_at, heartbeat_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, now(), now())
+		ON CONFLICT (id) DO UPDATE SET
+			queues = EXCLUDED.queues,
+			task_names = EXCLUDED.task_names,
+			max_parallel_tasks = EXCLUDED.max_parallel_tasks,
+			heartbeat_at = EXCLUDED.heartbeat_at`,
+		pb.workerID, consumerTag, hostname, os.Getpid(),
+		pq.StringArray(queues), pq.StringArray(names), maxParallelTasks).Error
+}
+
+// heartbeatWorker refreshes the registration of this broker while it is consuming
+func (pb *Broker) heartbeatWorker() error {
+	pb.mu.Lock()
+	consumerTag := pb.consumerTag
+	pb.mu.Unlock()
+
+	if consumerTag == "" {
+		// Not consuming
+		return nil
+	}
+	return pb.register(consumerTag)
+}
+
+// deregister removes this broker from the workers table
+func (pb *Broker) deregister() error {
+	pb.mu.Lock()
+	pb.consumerTag = ""
+	pb.mu.Unlock()
+
+	return DB.Where("id = ?", pb.workerID).Delete(&Worker{}).Error
+}
+
+// heartbeatDeadline returns the time before which a worker without heartbeat is dead,
+// computed by Postgres like the heartbeats to avoid clock drifts between the processes
+func heartbeatDeadline() interface{} {
+	return gorm.Expr("now() - ? * interval '1 second'", WorkerTimeout.Seconds())
+}
+
+// deleteDeadWorkers removes the workers dead for more than 24 hours
+func deleteDeadWorkers() {
+	DB.Where("heartbeat_at < now() - interval '24 hours'").
+		Delete(&Worker{})
+}